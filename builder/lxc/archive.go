@@ -0,0 +1,498 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ExtractCommand is the argument that makes the plugin extract an archive
+// read from stdin, see ExtractMain. The plugin runs itself with it through
+// sudo to extract archives as root.
+const ExtractCommand = "lxc-extract"
+
+// Whiteouts in a layer of an OCI image remove files of the layers below it,
+// an opaque whiteout removes the contents of its directory.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// extractArchive extracts an archive to dest on the host as root, in this
+// process if it runs as root and with the plugin run through sudo otherwise.
+// The progress is reported to the ui.
+func extractArchive(ctx context.Context, driver Driver, ui packer.Ui, archive string, dest string) error {
+	var stdin io.Reader
+	args := []string{dest}
+
+	f, err := os.Open(archive)
+	if err == nil {
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		stdin = &progressReader{
+			r:    f,
+			size: fi.Size(),
+			report: func(percent int64) {
+				ui.Message(fmt.Sprintf("Extracted %d%% of %s", percent, filepath.Base(archive)))
+			},
+		}
+	} else if os.IsPermission(err) {
+		// Only root can read it, no progress then
+		args = append(args, archive)
+	} else {
+		return fmt.Errorf("Error opening archive: %s", err)
+	}
+
+	if os.Geteuid() == 0 && stdin != nil {
+		if err := ExtractArchive(stdin, dest); err != nil {
+			return fmt.Errorf("Error extracting %s: %s", archive, err)
+		}
+		return nil
+	}
+	return sudoExtract(ctx, driver, args, stdin)
+}
+
+// extractLayer extracts a layer of an OCI image to the rootfs in dest as
+// root, like extractArchive.
+func extractLayer(ctx context.Context, driver Driver, layer string, dest string) error {
+	if os.Geteuid() == 0 {
+		if err := ExtractLayer(layer, dest); err != nil {
+			return fmt.Errorf("Error extracting layer %s: %s", filepath.Base(layer), err)
+		}
+		return nil
+	}
+	return sudoExtract(ctx, driver, []string{"-layer", dest, layer}, nil)
+}
+
+// sudoExtract runs ExtractMain as root through the plugin executable.
+func sudoExtract(ctx context.Context, driver Driver, args []string, stdin io.Reader) error {
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return fmt.Errorf("Error finding the plugin executable: %s", err)
+	}
+	return driver.SudoCommand(ctx, &HostCmd{
+		Args:  append([]string{self, ExtractCommand}, args...),
+		Stdin: stdin,
+	})
+}
+
+// ExtractMain extracts an archive to the directory in args[0]. The archive is
+// read from the path in args[1] if there is one and from stdin otherwise.
+// With -layer, the archive is a layer of an OCI image read from args[1]. It
+// returns the exit status of the command.
+func ExtractMain(args []string) int {
+	flags := flag.NewFlagSet(ExtractCommand, flag.ContinueOnError)
+	layer := flags.Bool("layer", false, "extract a layer of an OCI image")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+
+	if len(args) < 1 || len(args) > 2 || (*layer && len(args) != 2) {
+		fmt.Fprintf(os.Stderr, "Usage: %s DEST [ARCHIVE]\n       %s -layer DEST LAYER\n", ExtractCommand, ExtractCommand)
+		return 2
+	}
+
+	var err error
+	if *layer {
+		err = ExtractLayer(args[1], args[0])
+	} else if len(args) == 2 {
+		var f *os.File
+		f, err = os.Open(args[1])
+		if err == nil {
+			err = ExtractArchive(f, args[0])
+			f.Close()
+		}
+	} else {
+		err = ExtractArchive(os.Stdin, args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// ExtractArchive extracts a tar archive, uncompressed or compressed with
+// gzip, xz, bzip2 or zstd, to dest. Ownership is kept as numeric ids,
+// together with modes, times, xattrs, hardlinks and device nodes. Entries
+// can't be written outside of dest, neither with .. nor through symlinks.
+func ExtractArchive(r io.Reader, dest string) error {
+	return extract(r, dest, nil, true)
+}
+
+// ExtractLayer extracts a layer of an OCI image to the rootfs in dest like
+// ExtractArchive. The whiteouts of the layer are applied to the layers below
+// it first, they are not extracted themselves.
+func ExtractLayer(layer string, dest string) error {
+	if err := applyWhiteouts(layer, dest); err != nil {
+		return err
+	}
+
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return extract(f, dest, func(hdr *tar.Header) bool {
+		return strings.HasPrefix(path.Base(hdr.Name), whiteoutPrefix)
+	}, true)
+}
+
+// extractImage extracts an image archive, a docker save or OCI layout tar,
+// to dest as the user running packer. Ownership isn't kept, only root could
+// do that, and the files stay writable by the user so they can be removed.
+func extractImage(r io.Reader, dest string) error {
+	return extract(r, dest, nil, false)
+}
+
+// applyWhiteouts removes what the whiteouts of a layer remove from dest.
+func applyWhiteouts(layer string, dest string) error {
+	f, err := os.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, closer, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading layer: %s", err)
+		}
+
+		dir, base := path.Split(path.Clean("/" + hdr.Name))
+		switch {
+		case base == whiteoutOpaque:
+			err = clearDir(dest, dir)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			// The whiteout itself is removed, not what a symlink points to
+			var target string
+			target, err = entryPath(dest, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err == nil {
+				err = os.RemoveAll(target)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Error applying whiteout %s: %s", hdr.Name, err)
+		}
+	}
+}
+
+// clearDir removes the contents of a directory of the rootfs in dest.
+func clearDir(dest string, dir string) error {
+	for _, part := range strings.Split(dir, "/") {
+		if part == ".." {
+			return fmt.Errorf("Refusing to extract outside of %s: %s", dest, dir)
+		}
+	}
+	resolved, err := resolveInRoot(dest, dir, localReadlink)
+	if err != nil {
+		return err
+	}
+	if resolved == filepath.Clean(dest) {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(resolved)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(resolved, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract extracts a tar archive to dest, leaving out the entries skip
+// returns true for. Without owned the files belong to the user extracting.
+func extract(r io.Reader, dest string, skip func(*tar.Header) bool, owned bool) error {
+	r, closer, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	var dirs []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading archive: %s", err)
+		}
+		if skip != nil && skip(hdr) {
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, dest, owned); err != nil {
+			return fmt.Errorf("Error extracting %s: %s", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	// Extracting into a directory changes its times, they are set last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := entryPath(dest, dirs[i].Name)
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, accessTime(dirs[i]), dirs[i].ModTime); err != nil {
+			return fmt.Errorf("Error setting times of %s: %s", dirs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// decompress detects the compression of an archive from its magic bytes.
+func decompress(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	noop := func() {}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), noop, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, noop, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return br, noop, nil
+}
+
+// entryPath returns where an entry of the archive goes. Symlinks in its
+// parent directories are resolved inside of dest, the entry itself is never
+// followed.
+func entryPath(dest string, name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Refusing to extract outside of %s: %s", dest, name)
+		}
+	}
+
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return filepath.Clean(dest), nil
+	}
+	parent, err := resolveInRoot(dest, path.Dir(clean), localReadlink)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(clean)), nil
+}
+
+func localReadlink(path string) (string, bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", false, nil
+	}
+	target, err := os.Readlink(path)
+	return target, true, err
+}
+
+// paxXattrPrefix is the prefix of PAX records holding extended attributes, as
+// written by GNU tar and bsdtar.
+const paxXattrPrefix = "SCHILY.xattr."
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest string, owned bool) error {
+	target, err := entryPath(dest, hdr.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Replace what is there, unless both are directories
+	if fi, err := os.Lstat(target); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// Symlinks are only resolved inside of dest, the target is kept as is
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		if !owned {
+			return nil
+		}
+		return os.Lchown(target, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		source, err := entryPath(dest, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(syscall.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devMode = syscall.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devMode = syscall.S_IFBLK
+		}
+		dev := mkdev(hdr.Devmajor, hdr.Devminor)
+		if err := syscall.Mknod(target, devMode|uint32(mode.Perm()), dev); err != nil {
+			return err
+		}
+	default:
+		// Global and extended headers are handled by archive/tar, anything
+		// else has no place in a rootfs
+		return nil
+	}
+
+	// chown clears the setuid and setgid bits, so it comes first
+	if owned {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	} else {
+		mode = mode&os.ModePerm | 0600
+		if hdr.Typeflag == tar.TypeDir {
+			mode |= 0700
+		}
+	}
+	if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := syscall.Setxattr(target, name, []byte(value), 0); err != nil {
+			return fmt.Errorf("Error setting xattr %s: %s", name, err)
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return os.Chtimes(target, accessTime(hdr), hdr.ModTime)
+	}
+	return nil
+}
+
+// accessTime returns the access time of an entry, which only some archive
+// formats have.
+func accessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// mkdev encodes a device number the way linux does.
+func mkdev(major int64, minor int64) int {
+	return int((major&0xfff)<<8 | (major&^0xfff)<<32 | minor&0xff | (minor&^0xff)<<12)
+}
+
+// progressReader reports every 10 percent of the size that has been read.
+type progressReader struct {
+	r      io.Reader
+	size   int64
+	read   int64
+	last   int64
+	report func(percent int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.size > 0 {
+		percent := p.read * 100 / p.size / 10 * 10
+		if percent > p.last {
+			p.last = percent
+			p.report(percent)
+		}
+	}
+	return n, err
+}
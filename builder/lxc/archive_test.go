@@ -0,0 +1,234 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testFiles creates files, or directories for names ending in /, below dir.
+func testFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractLayer(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	rootfs := filepath.Join(dir, "rootfs")
+	outside := filepath.Join(dir, "outside")
+
+	// The lower layers
+	testFiles(t, rootfs, "a/keep", "a/gone", "b/x", "b/sub/y", "c/z")
+	testFiles(t, outside, "victim")
+	if err := os.Symlink(outside, filepath.Join(rootfs, "lnk")); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := filepath.Join(dir, "layer.tar")
+	content := testTar(t,
+		tarEntry{Name: "b/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "b/new", Typeflag: tar.TypeReg, Content: "new"},
+		tarEntry{Name: "a/.wh.gone", Typeflag: tar.TypeReg},
+		tarEntry{Name: "b/.wh..wh..opq", Typeflag: tar.TypeReg},
+		tarEntry{Name: "./lnk/.wh.victim", Typeflag: tar.TypeReg},
+		tarEntry{Name: "c/.wh.missing", Typeflag: tar.TypeReg},
+	)
+	if err := ioutil.WriteFile(layer, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExtractLayer(layer, rootfs); err != nil {
+		t.Fatalf("ExtractLayer: %s", err)
+	}
+
+	for _, name := range []string{"a/keep", "b/new", "c/z"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); err != nil {
+			t.Errorf("%s is missing: %s", name, err)
+		}
+	}
+	for _, name := range []string{"a/gone", "a/.wh.gone", "b/x", "b/sub", "b/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim")); err != nil {
+		t.Errorf("whiteout removed a file outside of the rootfs: %s", err)
+	}
+}
+
+func TestExtractMain_usage(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"a", "b", "c"},
+		{"-layer", "dest"},
+		{"-unknown", "dest"},
+	}
+	for _, args := range cases {
+		if status := ExtractMain(args); status != 2 {
+			t.Errorf("ExtractMain(%q) = %d, want 2", args, status)
+		}
+	}
+}
+
+func TestExtractArchive_xattrs(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.user.packer": "lxc",
+			"LIBARCHIVE.creationtime":  "0",
+		},
+	})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ExtractArchive(&buf, dir)
+	if err != nil && strings.HasSuffix(err.Error(), syscall.ENOTSUP.Error()) {
+		t.Skip("no user xattrs on this filesystem")
+	}
+	if err != nil {
+		t.Fatalf("ExtractArchive: %s", err)
+	}
+
+	value := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(dir, "file"), "user.packer", value)
+	if err != nil {
+		t.Fatalf("Getxattr: %s", err)
+	}
+	if string(value[:n]) != "lxc" {
+		t.Errorf("user.packer = %q, want lxc", value[:n])
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	testFiles(t, dir, "usr/lib/")
+	if err := os.Symlink("usr/lib", filepath.Join(dir, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{"./etc/hostname", "etc/hostname", false},
+		{"/etc/hostname", "etc/hostname", false},
+		{"./", "", false},
+		{"lib/libc.so", "usr/lib/libc.so", false},
+		// The entry itself is replaced, not followed
+		{"lib", "lib", false},
+		{"../escape", "", true},
+		{"etc/../../escape", "", true},
+		{"up/escape", "", true},
+	}
+	for _, c := range cases {
+		got, err := entryPath(dir, c.name)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: got %s, expected an error", c.name, got)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, c.want); err != nil || got != want {
+			t.Errorf("%s: got %s, %v, want %s", c.name, got, err, want)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "rootfs")
+	outside := filepath.Join(dir, "outside")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.Copy(zw, testTar(t,
+		tarEntry{Name: "./etc/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "./etc/hostname", Typeflag: tar.TypeReg, Content: "packer"},
+		tarEntry{Name: "./etc/hostname.bak", Typeflag: tar.TypeLink, Linkname: "./etc/hostname"},
+		tarEntry{Name: "./abs", Typeflag: tar.TypeSymlink, Linkname: outside},
+		tarEntry{Name: "./abs/file", Typeflag: tar.TypeReg, Content: "inside"},
+	))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compression is detected from the content
+	if err := ExtractArchive(&buf, dest); err != nil {
+		t.Fatalf("ExtractArchive: %s", err)
+	}
+	for _, name := range []string{"etc/hostname", "etc/hostname.bak"} {
+		if content, err := ioutil.ReadFile(filepath.Join(dest, name)); err != nil || string(content) != "packer" {
+			t.Errorf("%s = %q, %v", name, content, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "abs")); err != nil || target != outside {
+		t.Errorf("abs links to %q, %v", target, err)
+	}
+	// Absolute symlinks are resolved inside of dest
+	if _, err := os.Stat(filepath.Join(dest, outside, "file")); err != nil {
+		t.Errorf("abs/file not extracted inside of dest: %s", err)
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("entry was written outside of dest: %v", err)
+	}
+}
+
+func TestExtractArchive_refused(t *testing.T) {
+	cases := [][]tarEntry{
+		{{Name: "../escape", Typeflag: tar.TypeReg}},
+		{{Name: "etc/../../escape", Typeflag: tar.TypeReg}},
+		{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../outside/passwd"}},
+		{
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			{Name: "up/escape", Typeflag: tar.TypeReg},
+		},
+	}
+	for _, entries := range cases {
+		dir := testDir(t)
+		testFiles(t, dir, "outside/passwd")
+		err := ExtractArchive(testTar(t, entries...), filepath.Join(dir, "rootfs"))
+		_, statErr := os.Stat(filepath.Join(dir, "outside", "escape"))
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Errorf("%s: extracted, expected an error", entries[len(entries)-1].Name)
+		}
+		if !os.IsNotExist(statErr) {
+			t.Errorf("%s: written outside of dest", entries[len(entries)-1].Name)
+		}
+	}
+}
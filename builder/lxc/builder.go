@@ -1,11 +1,15 @@
 package lxc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/packer"
@@ -22,7 +26,9 @@ type wrappedCommandTemplate struct {
 
 type Builder struct {
 	config *Config
+	driver Driver
 	runner multistep.Runner
+	cancel context.CancelFunc
 }
 
 func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
@@ -40,41 +46,72 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		return nil, errors.New("The lxc builder only works on linux environments.")
 	}
 
+	// Every process spawned by the steps is killed when the build is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	defer cancel()
+
+	// Commands are wrapped concurrently, each render gets its own context
 	wrappedCommand := func(command string) (string, error) {
-		b.config.ctx.Data = &wrappedCommandTemplate{Command: command}
-		return interpolate.Render(b.config.CommandWrapper, &b.config.ctx)
+		ctx := b.config.ctx
+		ctx.Data = &wrappedCommandTemplate{Command: command}
+		return interpolate.Render(b.config.CommandWrapper, &ctx)
+	}
+
+	if b.driver == nil {
+		driver, err := newDriver(b.config, wrappedCommand)
+		if err != nil {
+			return nil, err
+		}
+		b.driver = driver
+	}
+
+	if version, err := b.driver.Version(ctx); err != nil {
+		log.Printf("Error reading LXC version: %s", err)
+	} else {
+		log.Printf("LXC version: %s", version)
 	}
 
 	steps := []multistep.Step{
 		new(stepPrepareOutputDir),
 		new(stepLxcCreate),
+		new(stepDiagnostics),
 		&StepWaitInit{
-			WaitTimeout: b.config.InitTimeout,
+			WaitTimeout:    b.config.InitTimeout,
+			NetworkTimeout: b.config.NetworkTimeout,
 		},
 		new(StepProvision),
 		new(stepExport),
 	}
 
+	if b.config.RootFs.Download() {
+		steps = append([]multistep.Step{
+			&common.StepDownload{
+				Checksum:     b.config.RootFs.Checksum,
+				ChecksumType: b.config.RootFs.ChecksumType,
+				Description:  "rootfs archive",
+				ResultKey:    "rootfs_archive",
+				Url:          []string{b.config.RootFs.Archive},
+				Extension:    archiveExtension(b.config.RootFs.Archive),
+			},
+		}, steps...)
+	}
+
 	// Setup the state bag
 	state := new(multistep.BasicStateBag)
 	state.Put("config", b.config)
+	state.Put("context", ctx)
 	state.Put("cache", cache)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
-	state.Put("wrappedCommand", CommandWrapper(wrappedCommand))
-
-	// Run
-	if b.config.PackerDebug {
-		b.runner = &multistep.DebugRunner{
-			Steps:   steps,
-			PauseFn: common.MultistepDebugFn(ui),
-		}
-	} else {
-		b.runner = &multistep.BasicRunner{Steps: steps}
-	}
+	state.Put("driver", b.driver)
 
+	// Run, the runner takes care of -debug and -on-error
+	b.runner = common.NewRunnerWithPauseFn(steps, b.config.PackerConfig, ui, state)
 	b.runner.Run(state)
 
+	b.announceContainer(ui, state)
+
 	// If there was an error, return that
 	if rawErr, ok := state.GetOk("error"); ok {
 		return nil, rawErr.(error)
@@ -111,9 +148,58 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 	return artifact, nil
 }
 
+// announceContainer tells how to get into the build container if it was
+// kept by keep_container, or left behind because -on-error skipped the
+// cleanup. Containers the build didn't create are never announced.
+func (b *Builder) announceContainer(ui packer.Ui, state multistep.StateBag) {
+	if _, ok := state.GetOk("container_created"); !ok {
+		return
+	}
+	if kept, ok := state.GetOk("container_kept"); ok && !kept.(bool) {
+		return
+	}
+
+	name := b.config.ContainerName
+	info, err := b.driver.Info(context.Background(), name)
+	if err != nil {
+		return
+	}
+
+	lxcPath := []string{}
+	if b.config.LxcPath != LxcDir {
+		lxcPath = append(lxcPath, "-P", b.config.LxcPath)
+	}
+	command := ShellJoin(append(append([]string{"sudo", "lxc-attach"}, lxcPath...), "--name", name)...)
+	if info.State == "STOPPED" {
+		command = ShellJoin(append(append([]string{"sudo", "lxc-start"}, lxcPath...), "--daemon", "--name", name)...) + " && " + command
+	}
+	if b.config.Driver == DriverLxd {
+		command = ShellJoin("lxc", "exec", name, "--", "/bin/sh")
+		if info.State == "STOPPED" {
+			command = ShellJoin("lxc", "start", name) + " && " + command
+		}
+	}
+	ui.Say(fmt.Sprintf("Container %s was kept, attach to it with:\n  %s", name, command))
+}
+
 func (b *Builder) Cancel() {
+	if b.cancel != nil {
+		log.Println("Terminating running commands...")
+		b.cancel()
+	}
+
 	if b.runner != nil {
 		log.Println("Cancelling the step runner...")
 		b.runner.Cancel()
 	}
 }
+
+// archiveExtension returns the extension of an archive URL, like tar.xz, to
+// keep it on the file in the cache.
+func archiveExtension(url string) string {
+	name := path.Base(strings.SplitN(url, "?", 2)[0])
+	if i := strings.Index(name, ".tar"); i >= 0 {
+		return name[i+1:]
+	}
+	return "tar"
+}
@@ -0,0 +1,339 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+)
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var _ packer.Builder = new(Builder)
+}
+
+// testDir creates a temporary directory, the caller removes it.
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer-lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// testConfig returns the config of a build from a rootfs archive with all
+// paths below dir.
+func testConfig(t *testing.T, dir string) map[string]interface{} {
+	lxcConfig := filepath.Join(dir, "lxc.config")
+	if err := ioutil.WriteFile(lxcConfig, []byte("lxc.utsname = packer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "lxc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]interface{}{
+		"packer_build_name":     "test",
+		"container_name":        "packer-test",
+		"config_file":           lxcConfig,
+		"output_directory":      filepath.Join(dir, "output"),
+		"diagnostics_directory": filepath.Join(dir, "diagnostics"),
+		"lxc_path":              filepath.Join(dir, "lxc"),
+		"target_runlevel":       3,
+		"init_timeout":          "10s",
+		"rootfs": map[string]interface{}{
+			"config":  lxcConfig,
+			"archive": testArchive(t, dir),
+		},
+	}
+}
+
+// testArchive writes a gzipped rootfs archive with a single file.
+func testArchive(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "rootfs.tar.gz")
+	if err := ioutil.WriteFile(path, testArchiveContent(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testArchiveContent(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.Copy(zw, testTar(t,
+		tarEntry{Name: "rootfs/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "rootfs/etc/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "rootfs/etc/hostname", Typeflag: tar.TypeReg, Content: "packer\n"},
+	))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testDriver returns a MockDriver for containers with a directory rootfs
+// below lxcPath. Commands on the host only have their output faked, tar
+// creates an empty archive and /sbin/runlevel reports runlevel 3.
+func testDriver(lxcPath string) *MockDriver {
+	return &MockDriver{
+		SudoFn: func(cmd *HostCmd) error {
+			if len(cmd.Args) == 2 && cmd.Args[0] == "cat" && filepath.Base(cmd.Args[1]) == "config" && cmd.Stdout != nil {
+				fmt.Fprintf(cmd.Stdout, "lxc.rootfs.path = dir:%s\n", filepath.Join(filepath.Dir(cmd.Args[1]), "rootfs"))
+			}
+			if cmd.Args[0] == "tar" {
+				for i, arg := range cmd.Args[:len(cmd.Args)-1] {
+					if arg == "-czf" {
+						return ioutil.WriteFile(cmd.Args[i+1], nil, 0644)
+					}
+				}
+			}
+			return nil
+		},
+		AttachFn: func(name string, cmd *AttachCmd) (int, error) {
+			if cmd.Args[0] == "/sbin/runlevel" {
+				io.WriteString(cmd.Stdout, "N 3\n")
+			}
+			return 0, nil
+		},
+	}
+}
+
+// testUi collects everything said to the ui.
+type testUi struct {
+	sync.Mutex
+	output bytes.Buffer
+}
+
+func (u *testUi) Ask(string) (string, error) { return "", nil }
+func (u *testUi) Say(message string)         { u.write(message) }
+func (u *testUi) Message(message string)     { u.write(message) }
+func (u *testUi) Error(message string)       { u.write(message) }
+func (u *testUi) Machine(string, ...string)  {}
+
+func (u *testUi) write(message string) {
+	u.Lock()
+	defer u.Unlock()
+	u.output.WriteString(message + "\n")
+}
+
+func (u *testUi) String() string {
+	u.Lock()
+	defer u.Unlock()
+	return u.output.String()
+}
+
+// testState returns the state of a build with the config, for running single
+// steps against a testDriver.
+func testState(t *testing.T, raw map[string]interface{}) (multistep.StateBag, *MockDriver, *testUi) {
+	config, err := NewConfig(raw)
+	if err != nil {
+		t.Fatalf("NewConfig: %s", err)
+	}
+	driver := testDriver(config.LxcPath)
+	ui := new(testUi)
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", config)
+	state.Put("context", context.Background())
+	state.Put("driver", driver)
+	state.Put("hook", new(packer.MockHook))
+	state.Put("ui", ui)
+	return state, driver, ui
+}
+
+// testBuild prepares and runs a build with the driver.
+func testBuild(t *testing.T, raw map[string]interface{}, driver Driver, cache packer.Cache) (packer.Artifact, *testUi, error) {
+	var b Builder
+	if _, err := b.Prepare(raw); err != nil {
+		t.Fatalf("Prepare: %s", err)
+	}
+	b.driver = driver
+
+	if cache == nil {
+		cache = &packer.FileCache{CacheDir: filepath.Join(filepath.Dir(b.config.OutputDir), "cache")}
+	}
+	ui := new(testUi)
+	artifact, err := b.Run(ui, new(packer.MockHook), cache)
+	return artifact, ui, err
+}
+
+func TestBuilderRun_rootfsDownload(t *testing.T) {
+	content := testArchiveContent(t)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	checksum := sha256.Sum256(content)
+	cacheDir := testDir(t)
+	defer os.RemoveAll(cacheDir)
+	cache := &packer.FileCache{CacheDir: cacheDir}
+
+	// The second build finds the archive in the cache
+	for i := 1; i <= 2; i++ {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		rootfs := raw["rootfs"].(map[string]interface{})
+		rootfs["archive"] = server.URL + "/rootfs.tar.gz"
+		rootfs["checksum"] = hex.EncodeToString(checksum[:])
+		rootfs["checksum_type"] = "sha256"
+
+		_, ui, err := testBuild(t, raw, testDriver(raw["lxc_path"].(string)), cache)
+		if err != nil {
+			t.Fatalf("build %d: %s\n%s", i, err, ui)
+		}
+		if !strings.Contains(ui.String(), "Creating container from archive: "+cache.CacheDir) {
+			t.Errorf("build %d didn't use the archive in the cache:\n%s", i, ui)
+		}
+		if requests != 1 {
+			t.Errorf("build %d: %d requests, want 1", i, requests)
+		}
+	}
+}
+
+func TestBuilderRun_rootfsDownloadChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testArchiveContent(t))
+	}))
+	defer server.Close()
+
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	rootfs := raw["rootfs"].(map[string]interface{})
+	rootfs["archive"] = server.URL + "/rootfs.tar.gz"
+	rootfs["checksum"] = strings.Repeat("0", 64)
+	rootfs["checksum_type"] = "sha256"
+
+	driver := testDriver(raw["lxc_path"].(string))
+	_, ui, err := testBuild(t, raw, driver, nil)
+	if err == nil {
+		t.Fatalf("build succeeded with a wrong checksum:\n%s", ui)
+	}
+	if len(driver.SudoCommands) != 0 {
+		t.Errorf("container was created from a broken download: %q", driver.SudoCommands)
+	}
+}
+
+func TestBuilderRun_sidediskDestExists(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	raw["sidedisks"] = []map[string]interface{}{
+		{"type": "copy", "source": dir, "dest": "/etc", "persist": false},
+	}
+
+	// The container is only mocked, its rootfs already has /etc
+	rootfs := filepath.Join(dir, "lxc", "packer-test", "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := testDriver(raw["lxc_path"].(string))
+	_, ui, err := testBuild(t, raw, driver, nil)
+	if err == nil || !strings.Contains(err.Error(), "already exists in the rootfs") {
+		t.Fatalf("expected an error for the existing dest, got %v\n%s", err, ui)
+	}
+	for _, args := range driver.SudoCommands {
+		if args[len(args)-1] == filepath.Join(rootfs, "etc") {
+			t.Errorf("sidedisk was loaded: %q", args)
+		}
+	}
+}
+
+func TestBuilderRun_sidediskRemoved(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	raw["sidedisks"] = []map[string]interface{}{
+		{"type": "copy", "source": dir, "dest": "/opt/deps", "persist": false},
+	}
+
+	driver := testDriver(raw["lxc_path"].(string))
+	_, ui, err := testBuild(t, raw, driver, nil)
+	if err != nil {
+		t.Fatalf("build: %s\n%s", err, ui)
+	}
+
+	want := []string{"rm", "-rf", "--", filepath.Join(dir, "lxc", "packer-test", "rootfs", "opt", "deps")}
+	for _, args := range driver.SudoCommands {
+		if reflect.DeepEqual(args, want) {
+			return
+		}
+	}
+	t.Errorf("sidedisk not removed, commands: %q", driver.SudoCommands)
+}
+
+func TestBuilderRun(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+
+	driver := testDriver(raw["lxc_path"].(string))
+	artifact, ui, err := testBuild(t, raw, driver, nil)
+	if err != nil {
+		t.Fatalf("build: %s\n%s", err, ui)
+	}
+
+	files := artifact.Files()
+	sort.Strings(files)
+	output := filepath.Join(dir, "output")
+	want := []string{filepath.Join(output, "lxc-config"), filepath.Join(output, "metadata.json"), filepath.Join(output, "rootfs.tar.gz")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("artifact files = %q, want %q", files, want)
+	}
+	if !driver.StopCalled || !driver.DestroyCalled {
+		t.Errorf("container was not stopped and destroyed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "diagnostics")); !os.IsNotExist(err) {
+		t.Errorf("diagnostics collected for a successful build: %v", err)
+	}
+}
+
+func TestBuilderRun_announceContainer(t *testing.T) {
+	cases := []struct {
+		name     string
+		keep     string
+		exists   bool
+		announce bool
+	}{
+		{"destroyed", KeepContainerNever, false, false},
+		{"kept", KeepContainerAlways, false, true},
+		// The existing container is in the way, but not kept by the build
+		{"exists", KeepContainerAlways, true, false},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		raw["keep_container"] = c.keep
+
+		driver := testDriver(raw["lxc_path"].(string))
+		if c.exists {
+			driver.setState("packer-test", "STOPPED")
+		}
+		_, ui, _ := testBuild(t, raw, driver, nil)
+		if announced := strings.Contains(ui.String(), "was kept"); announced != c.announce {
+			t.Errorf("%s: announced = %t, want %t\n%s", c.name, announced, c.announce, ui)
+		}
+	}
+}
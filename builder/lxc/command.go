@@ -1,15 +1,141 @@
 package lxc
 
 import (
+	"bytes"
+	"context"
+	"log"
+	"os"
 	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
 // CommandWrapper is a type that given a command, will possibly modify that
 // command in-flight. This might return an error.
 type CommandWrapper func(string) (string, error)
 
-// ShellCommand takes a command string and returns an *exec.Cmd to execute
-// it within the context of a shell (/bin/sh).
-func ShellCommand(command string) *exec.Cmd {
-	return exec.Command("/bin/sh", "-c", command)
+// ShellCommandContext returns a *Cmd to execute command within the context
+// of a shell (/bin/sh).
+func ShellCommandContext(ctx context.Context, command string) *Cmd {
+	return CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// Cmd is an *exec.Cmd that is terminated together with everything it spawned
+// when the build is cancelled.
+type Cmd struct {
+	*exec.Cmd
+
+	ctx   context.Context
+	done  chan struct{}
+	group bool
+}
+
+// CommandContext returns a *Cmd to execute the named program with the given
+// arguments. Cancelling ctx sends SIGTERM to the process group of the
+// command, followed by SIGKILL if it did not exit within a few seconds.
+//
+// When packer runs on a terminal the command stays in the foreground process
+// group instead, a background group is stopped as soon as sudo prompts for a
+// password on the terminal. Only the command itself is signalled then.
+func CommandContext(ctx context.Context, name string, args ...string) *Cmd {
+	cmd := exec.Command(name, args...)
+	group := !isTerminal(os.Stdin)
+	if group {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	return &Cmd{Cmd: cmd, ctx: ctx, group: group}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+func (c *Cmd) Start() error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.Cmd.Start(); err != nil {
+		return err
+	}
+
+	c.done = make(chan struct{})
+	go c.watch(c.Process.Pid, c.done)
+	return nil
+}
+
+func (c *Cmd) Wait() error {
+	defer close(c.done)
+	return c.Cmd.Wait()
+}
+
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *Cmd) Output() ([]byte, error) {
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	err := c.Run()
+	return stdout.Bytes(), err
+}
+
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	var output bytes.Buffer
+	c.Stdout = &output
+	c.Stderr = &output
+	err := c.Run()
+	return output.Bytes(), err
+}
+
+func (c *Cmd) watch(pid int, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-c.ctx.Done():
+	}
+
+	// A negative pid signals the whole process group
+	target := pid
+	if c.group {
+		target = -pid
+	}
+
+	log.Printf("Terminating process %d: %#v", target, c.Args)
+	syscall.Kill(target, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.Printf("Killing process %d", target)
+		syscall.Kill(target, syscall.SIGKILL)
+	}
+}
+
+// ShellQuote quotes a string so that it is passed as a single, unmodified
+// argument when interpreted by a POSIX shell.
+func ShellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// ShellJoin quotes every argument with ShellQuote and joins them into a
+// single command line.
+func ShellJoin(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
 }
@@ -0,0 +1,44 @@
+package lxc
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":             "''",
+		"plain":        "plain",
+		"/usr/bin/a-b": "/usr/bin/a-b",
+		"two words":    "'two words'",
+		"it's":         `'it'"'"'s'`,
+		"$HOME":        "'$HOME'",
+		"a;b":          "'a;b'",
+		"*":            "'*'",
+	}
+	for s, want := range cases {
+		if got := ShellQuote(s); got != want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+
+	// The shell gets the arguments back unmodified
+	args := []string{"", "a b", "it's", "$HOME", "`id`", "\"x\"", "back\\slash", "new\nline"}
+	out, err := exec.Command(sh, "-c", `for a in `+ShellJoin(args...)+`; do printf '%s\0' "$a"; done`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("got %q, want %q", got, args)
+	}
+}
@@ -1,55 +1,99 @@
 package lxc
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hashicorp/packer/packer"
 )
 
 type LxcAttachCommunicator struct {
+	// RootFs is the rootfs of the container on the host. When it is empty
+	// the rootfs is reached through /proc of the init of the container.
 	RootFs        string
 	ContainerName string
-	CmdWrapper    CommandWrapper
+	Driver        Driver
+	Attach        AttachConfig
+
+	// Ctx cancels every command the communicator started when it is done.
+	Ctx context.Context
+
+	// Ui reports what directory uploads copied, it may be nil.
+	Ui packer.Ui
+
+	// uid and gid of AttachUser, looked up inside the container on first use
+	userIds []int
+
+	l           sync.Mutex
+	lastCommand string
 }
 
 func (c *LxcAttachCommunicator) DownloadDir(src string, dst string, exclude []string) error {
-	return fmt.Errorf("DownloadDir is not implemented for lxc")
+	src, err := c.rootfsPath(src)
+	if err != nil {
+		return err
+	}
+	log.Printf("Downloading directory '%s' from rootfs to '%s'", src, dst)
+
+	pr, pw := io.Pipe()
+	tarErr := make(chan error, 1)
+	go func() {
+		var err error
+		args := []string{"tar", "-C", src, "-cf", "-", "."}
+		if _, ok := c.files(); ok {
+			err = c.attach(&AttachCmd{Args: args, Stdout: pw})
+		} else {
+			err = c.Driver.SudoCommand(c.ctx(), &HostCmd{Args: args, Stdout: pw})
+		}
+		pw.CloseWithError(err)
+		tarErr <- err
+	}()
+
+	if err := untarDir(pr, dst, exclude); err != nil {
+		pr.CloseWithError(err)
+		<-tarErr
+		return fmt.Errorf("Error downloading directory '%s': %s", src, err)
+	}
+
+	if err := <-tarErr; err != nil {
+		return fmt.Errorf("Error downloading directory '%s': %s", src, err)
+	}
+
+	return nil
 }
 
 func (c *LxcAttachCommunicator) Start(cmd *packer.RemoteCmd) error {
-	localCmd, err := c.Execute(cmd.Command)
+	c.l.Lock()
+	c.lastCommand = cmd.Command
+	c.l.Unlock()
 
+	attachCmd, err := c.Execute(cmd.Command)
 	if err != nil {
 		return err
 	}
 
-	localCmd.Stdin = cmd.Stdin
-	localCmd.Stdout = cmd.Stdout
-	localCmd.Stderr = cmd.Stderr
-	if err := localCmd.Start(); err != nil {
-		return err
-	}
+	attachCmd.Stdin = cmd.Stdin
+	attachCmd.Stdout = cmd.Stdout
+	attachCmd.Stderr = cmd.Stderr
 
 	go func() {
-		exitStatus := 0
-		if err := localCmd.Wait(); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitStatus = 1
-
-				// There is no process-independent way to get the REAL
-				// exit status so we just try to go deeper.
-				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-					exitStatus = status.ExitStatus()
-				}
-			}
+		exitStatus, err := c.Driver.Attach(c.ctx(), c.ContainerName, attachCmd)
+		if err != nil {
+			log.Printf("lxc-attach execution failed: %s", err)
+			exitStatus = 1
 		}
 
 		log.Printf(
@@ -61,42 +105,135 @@ func (c *LxcAttachCommunicator) Start(cmd *packer.RemoteCmd) error {
 	return nil
 }
 
+// LastCommand returns the last command started through the communicator.
+func (c *LxcAttachCommunicator) LastCommand() string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.lastCommand
+}
+
 func (c *LxcAttachCommunicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
-	dst = filepath.Join(c.RootFs, dst)
-	log.Printf("Uploading to rootfs: %s", dst)
-	tf, err := ioutil.TempFile("", "packer-lxc-attach")
-	if err != nil {
-		return fmt.Errorf("Error uploading file to rootfs: %s", err)
+	if files, ok := c.files(); ok {
+		file := &ContainerFile{Path: dst, Mode: 0644, Content: r}
+		if fi != nil {
+			file.Mode = (*fi).Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			file.Uid, file.Gid = fileOwner(*fi)
+		}
+		log.Printf("Uploading to container: %s", dst)
+		return files.PushFile(c.ctx(), c.ContainerName, file)
 	}
-	defer os.Remove(tf.Name())
-	io.Copy(tf, r)
 
-	cpCmd, err := c.CmdWrapper(fmt.Sprintf("sudo cp %s %s", tf.Name(), dst))
+	dst, err := c.rootfsPath(dst)
 	if err != nil {
 		return err
 	}
+	log.Printf("Uploading to rootfs: %s", dst)
 
-	log.Printf("Running copy command: %s", dst)
+	commands := []*HostCmd{
+		{Args: []string{"tee", dst}, Stdin: r, Stdout: ioutil.Discard},
+	}
+	if fi != nil {
+		uid, gid := fileOwner(*fi)
+		commands = append(commands,
+			&HostCmd{Args: []string{"chown", fmt.Sprintf("%d:%d", uid, gid), dst}},
+			// chown clears the setuid and setgid bits, so chmod comes last
+			&HostCmd{Args: []string{"chmod", octalMode((*fi).Mode()), dst}},
+		)
+	} else {
+		commands = append(commands, &HostCmd{Args: []string{"chown", "0:0", dst}})
+	}
 
-	return ShellCommand(cpCmd).Run()
+	for _, command := range commands {
+		if err := c.Driver.SudoCommand(c.ctx(), command); err != nil {
+			return fmt.Errorf("Error uploading file to rootfs: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// fileOwner returns the owner of an uploaded file, root unless the file info
+// comes from the host filesystem.
+func fileOwner(fi os.FileInfo) (int, int) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return 0, 0
+}
+
+// octalMode formats the permissions of mode for chmod, including the setuid,
+// setgid and sticky bits.
+func octalMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+	return fmt.Sprintf("%04o", bits)
 }
 
 func (c *LxcAttachCommunicator) UploadDir(dst string, src string, exclude []string) error {
-	// TODO: remove any file copied if it appears in `exclude`
-	dest := filepath.Join(c.RootFs, dst)
-	log.Printf("Uploading directory '%s' to rootfs '%s'", src, dest)
-	cpCmd, err := c.CmdWrapper(fmt.Sprintf("sudo cp -R %s/. %s", src, dest))
+	if files, ok := c.files(); ok {
+		return c.pushDir(files, dst, src, exclude)
+	}
+
+	dest, err := c.rootfsPath(dst)
 	if err != nil {
 		return err
 	}
+	log.Printf("Uploading directory '%s' to rootfs '%s'", src, dest)
+	if err := sudo(c.ctx(), c.Driver, "mkdir", "-p", dest); err != nil {
+		return fmt.Errorf("Error uploading directory '%s': %s", src, err)
+	}
+
+	pr, pw := io.Pipe()
+	count := 0
+	tarErr := make(chan error, 1)
+	go func() {
+		var err error
+		count, err = tarDir(pw, src, exclude)
+		pw.CloseWithError(err)
+		tarErr <- err
+	}()
 
-	return ShellCommand(cpCmd).Run()
+	err = c.Driver.SudoCommand(c.ctx(), &HostCmd{
+		Args:  []string{"tar", "-C", dest, "-xpf", "-"},
+		Stdin: pr,
+	})
+	// Unblock the writer in case tar exited before reading everything
+	pr.Close()
+	if walkErr := <-tarErr; walkErr != nil && walkErr != io.ErrClosedPipe {
+		err = walkErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error uploading directory '%s': %s", src, err)
+	}
+
+	c.say(fmt.Sprintf("Uploaded %d files to %s", count, dst))
+	return nil
 }
 
 func (c *LxcAttachCommunicator) Download(src string, w io.Writer) error {
-	src = filepath.Join(c.RootFs, src)
+	if files, ok := c.files(); ok {
+		log.Printf("Downloading from container: %s", src)
+		return files.PullFile(c.ctx(), c.ContainerName, src, w)
+	}
+
+	src, err := c.rootfsPath(src)
+	if err != nil {
+		return err
+	}
 	log.Printf("Downloading from rootfs dir: %s", src)
 	f, err := os.Open(src)
+	if os.IsPermission(err) {
+		// The rootfs of a running container is only readable by root
+		return c.Driver.SudoCommand(c.ctx(), &HostCmd{Args: []string{"cat", src}, Stdout: w})
+	}
 	if err != nil {
 		return err
 	}
@@ -109,44 +246,439 @@ func (c *LxcAttachCommunicator) Download(src string, w io.Writer) error {
 	return nil
 }
 
-func (c *LxcAttachCommunicator) Execute(commandString string) (*exec.Cmd, error) {
-	log.Printf("Executing with lxc-attach in container: %s %s %s", c.ContainerName, c.RootFs, commandString)
-	command, err := c.CmdWrapper(
-		fmt.Sprintf("sudo lxc-attach --name %s -- /bin/sh -c \"%s\"", c.ContainerName, commandString))
+// say shows a message in the ui, and in the log without one.
+func (c *LxcAttachCommunicator) say(message string) {
+	log.Print(message)
+	if c.Ui != nil {
+		c.Ui.Message(message)
+	}
+}
+
+func (c *LxcAttachCommunicator) ctx() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
+	}
+	return c.Ctx
+}
+
+// pushDir uploads a directory with a driver that copies files itself, one
+// entry at a time.
+func (c *LxcAttachCommunicator) pushDir(files FileDriver, dst string, src string, exclude []string) error {
+	log.Printf("Uploading directory '%s' to container '%s'", src, dst)
+	err := files.PushFile(c.ctx(), c.ContainerName, &ContainerFile{Path: dst, Mode: os.ModeDir | 0755})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("Error uploading directory '%s': %s", src, err)
 	}
 
-	localCmd := ShellCommand(command)
-	log.Printf("Executing lxc-attach: %s %#v", localCmd.Path, localCmd.Args)
+	pr, pw := io.Pipe()
+	count := 0
+	tarErr := make(chan error, 1)
+	go func() {
+		var err error
+		count, err = tarDir(pw, src, exclude)
+		pw.CloseWithError(err)
+		tarErr <- err
+	}()
 
-	return localCmd, nil
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			file := &ContainerFile{
+				Path:    path.Join(dst, hdr.Name),
+				Mode:    hdr.FileInfo().Mode(),
+				Content: tr,
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				file.Content = strings.NewReader(hdr.Linkname)
+			}
+			err = files.PushFile(c.ctx(), c.ContainerName, file)
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+			<-tarErr
+			return fmt.Errorf("Error uploading directory '%s': %s", src, err)
+		}
+	}
+	if err := <-tarErr; err != nil {
+		return fmt.Errorf("Error uploading directory '%s': %s", src, err)
+	}
+
+	c.say(fmt.Sprintf("Uploaded %d files to %s", count, dst))
+	return nil
 }
 
-func (c *LxcAttachCommunicator) CheckInit() (string, error) {
-	log.Printf("Debug runlevel exec")
-	localCmd, err := c.Execute("/sbin/runlevel")
+// files returns the driver as FileDriver if it copies files in and out of
+// the container itself. The rootfs of the container is not on the host then,
+// all other file access happens inside of the container.
+func (c *LxcAttachCommunicator) files() (FileDriver, bool) {
+	files, ok := c.Driver.(FileDriver)
+	return files, ok
+}
+
+// attach runs a command as root in the container and fails on a non-zero
+// exit status.
+func (c *LxcAttachCommunicator) attach(cmd *AttachCmd) error {
+	exitStatus, err := c.Driver.Attach(c.ctx(), c.ContainerName, cmd)
+	if err == nil && exitStatus != 0 {
+		err = fmt.Errorf("%s exited with %d", cmd.Args[0], exitStatus)
+	}
+	return err
+}
+
+// rootfsPath resolves a path inside of the container to a path on the host,
+// following symlinks without ever leaving the rootfs. When the rootfs is not
+// on the host the path is resolved inside of the container.
+func (c *LxcAttachCommunicator) rootfsPath(path string) (string, error) {
+	root := c.RootFs
+	if _, ok := c.files(); ok {
+		root = "/"
+	} else if root == "" {
+		info, err := c.Driver.Info(c.ctx(), c.ContainerName)
+		if err != nil {
+			return "", err
+		}
+		if info.Pid == 0 {
+			return "", fmt.Errorf("Container %s is not running, its rootfs is not on the host", c.ContainerName)
+		}
+		root = fmt.Sprintf("/proc/%d/root", info.Pid)
+	}
 
+	resolved, err := resolveInRoot(root, path, c.readlink)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("Error resolving '%s' in rootfs: %s", path, err)
 	}
+	return resolved, nil
+}
 
-	pr, _ := localCmd.StdoutPipe()
-	if err = localCmd.Start(); err != nil {
-		return "", err
+// exists reports whether a resolved rootfs path exists on the host.
+func (c *LxcAttachCommunicator) exists(path string) (bool, error) {
+	path, err := c.rootfsPath(path)
+	if err != nil {
+		return false, err
+	}
+
+	if _, ok := c.files(); ok {
+		_, exitStatus, err := c.output(&AttachCmd{Args: []string{"test", "-e", path}})
+		return exitStatus == 0, err
 	}
 
-	output, err := ioutil.ReadAll(pr)
+	_, err = os.Lstat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if !os.IsPermission(err) {
+		return false, err
+	}
 
+	return sudo(c.ctx(), c.Driver, "test", "-e", path) == nil, nil
+}
+
+func (c *LxcAttachCommunicator) readlink(path string) (string, bool, error) {
+	if _, ok := c.files(); ok {
+		// readlink exits non-zero for anything that is not a symlink
+		target, exitStatus, err := c.output(&AttachCmd{Args: []string{"readlink", path}})
+		return target, err == nil && exitStatus == 0, err
+	}
+
+	return hostReadlink(c.ctx(), c.Driver, path)
+}
+
+// Execute returns the command that runs commandString with the configured
+// shell, user and environment in the container.
+func (c *LxcAttachCommunicator) Execute(commandString string) (*AttachCmd, error) {
+	log.Printf("Executing with lxc-attach in container: %s %s %s", c.ContainerName, c.RootFs, commandString)
+	shell := c.Attach.AttachShell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	cmd := &AttachCmd{
+		Args:     []string{shell, "-c", commandString},
+		Uid:      c.Attach.AttachUid,
+		Gid:      c.Attach.AttachGid,
+		ClearEnv: c.Attach.AttachClearEnv,
+		Env:      c.Attach.AttachEnv,
+	}
+
+	if c.Attach.AttachUser != "" {
+		ids, err := c.lookupUser(c.Attach.AttachUser)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Uid, cmd.Gid = &ids[0], &ids[1]
+	}
+
+	return cmd, nil
+}
+
+// lookupUser resolves a user name to its uid and gid inside the container.
+func (c *LxcAttachCommunicator) lookupUser(user string) ([]int, error) {
+	if c.userIds != nil {
+		return c.userIds, nil
+	}
+
+	ids := make([]int, 2)
+	for i, flag := range []string{"-u", "-g"} {
+		output, exitStatus, err := c.output(&AttachCmd{Args: []string{"id", flag, user}})
+		if err == nil && exitStatus != 0 {
+			err = fmt.Errorf("id exited with %d", exitStatus)
+		}
+		if err == nil {
+			ids[i], err = strconv.Atoi(output)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up attach_user '%s' in container: %s", user, err)
+		}
+	}
+
+	log.Printf("Resolved attach_user '%s' to uid %d, gid %d", user, ids[0], ids[1])
+	c.userIds = ids
+	return ids, nil
+}
+
+// Output runs a command in the container and returns its trimmed standard
+// output and exit status. A non-zero exit status is not an error.
+func (c *LxcAttachCommunicator) Output(commandString string) (string, int, error) {
+	cmd, err := c.Execute(commandString)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
+	return c.output(cmd)
+}
 
-	err = localCmd.Wait()
+func (c *LxcAttachCommunicator) output(cmd *AttachCmd) (string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
+	exitStatus, err := c.Driver.Attach(c.ctx(), c.ContainerName, cmd)
+	if err != nil {
+		return "", 0, err
+	}
+	if exitStatus != 0 {
+		log.Printf("stderr: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), exitStatus, nil
+}
+
+// IPAddresses returns the global IPv4 and IPv6 addresses of the container.
+// Without an interface name the addresses of all interfaces are reported by
+// the driver, otherwise they are read with ip inside of the container.
+func (c *LxcAttachCommunicator) IPAddresses(iface string) ([]string, []string, error) {
+	var addrs []string
+	if iface == "" {
+		info, err := c.Driver.Info(c.ctx(), c.ContainerName)
+		if err != nil {
+			return nil, nil, err
+		}
+		addrs = info.IPs
+	} else {
+		output, exitStatus, err := c.Output(ShellJoin("ip", "-o", "addr", "show", "dev", iface, "scope", "global"))
+		if err != nil {
+			return nil, nil, err
+		}
+		if exitStatus != 0 {
+			return nil, nil, fmt.Errorf("Reading addresses of %s exited with %d", iface, exitStatus)
+		}
+		for _, line := range strings.Split(output, "\n") {
+			// 2: eth0    inet 10.0.3.12/24 brd 10.0.3.255 scope global eth0
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && strings.HasPrefix(fields[2], "inet") {
+				addrs = append(addrs, strings.SplitN(fields[3], "/", 2)[0])
+			}
+		}
+	}
+
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast():
+		case ip.To4() != nil:
+			ipv4 = append(ipv4, addr)
+		default:
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	return ipv4, ipv6, nil
+}
+
+func (c *LxcAttachCommunicator) CheckInit() (string, error) {
+	log.Printf("Debug runlevel exec")
+	output, exitStatus, err := c.output(&AttachCmd{Args: []string{"/sbin/runlevel"}})
 	if err != nil {
 		return "", err
 	}
+	if exitStatus != 0 {
+		return "", fmt.Errorf("runlevel exited with %d", exitStatus)
+	}
+
+	return output, nil
+}
+
+// tarDir writes the contents of src as a tar stream to w, skipping every
+// path that matches one of the exclude patterns. Modes and symlinks are kept,
+// ownership is reset to root. It returns the number of files written.
+func tarDir(w io.Writer, src string, exclude []string) (int, error) {
+	count := 0
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if isExcluded(rel, exclude) {
+			log.Printf("Skipping excluded path: %s", rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "root", "root"
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, tw.Close()
+}
+
+// untarDir extracts the tar stream r into dst, skipping every entry that
+// matches one of the exclude patterns.
+func untarDir(r io.Reader, dst string, exclude []string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
 
-	return strings.TrimSpace(string(output)), nil
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := filepath.Clean(hdr.Name)
+		if rel == "." {
+			continue
+		}
+		if rel == ".." || strings.HasPrefix(rel, "../") || filepath.IsAbs(rel) {
+			return fmt.Errorf("Refusing to extract entry outside of destination: %s", hdr.Name)
+		}
+		if isExcluded(rel, exclude) {
+			log.Printf("Skipping excluded path: %s", rel)
+			continue
+		}
+
+		// The stream comes from the container, symlinks it extracted earlier
+		// must not lead later entries outside of dst
+		target, err := entryPath(dst, rel)
+		if err != nil {
+			return fmt.Errorf("Refusing to extract entry outside of destination: %s: %s", hdr.Name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, mode|0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping unsupported entry type '%c': %s", hdr.Typeflag, rel)
+		}
+	}
+}
+
+// isExcluded reports whether the slash separated relative path, or any of
+// its parent directories, matches one of the exclude glob patterns.
+func isExcluded(rel string, exclude []string) bool {
+	for _, pattern := range exclude {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(pattern, filepath.Base(p)); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,298 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	Name     string
+	Typeflag byte
+	Linkname string
+	Content  string
+}
+
+func testTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Typeflag,
+			Linkname: e.Linkname,
+			Mode:     0644,
+			Size:     int64(len(e.Content)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+		}
+		if e.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUntarDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+	outside := filepath.Join(dir, "outside")
+
+	stream := testTar(t,
+		tarEntry{Name: "etc/", Typeflag: tar.TypeDir},
+		tarEntry{Name: "etc/hostname", Typeflag: tar.TypeReg, Content: "build"},
+		tarEntry{Name: "skip/file", Typeflag: tar.TypeReg, Content: "skipped"},
+		tarEntry{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		tarEntry{Name: "a/pwned", Typeflag: tar.TypeReg, Content: "pwned"},
+	)
+	if err := untarDir(stream, dst, []string{"skip"}); err != nil {
+		t.Fatalf("untarDir: %s", err)
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(dst, "etc", "hostname")); err != nil || string(content) != "build" {
+		t.Errorf("etc/hostname = %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "skip")); !os.IsNotExist(err) {
+		t.Errorf("excluded path was extracted: %v", err)
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("entry was written outside of dst through a symlink: %v", err)
+	}
+	// Absolute symlinks are resolved inside of dst instead
+	if _, err := os.Stat(filepath.Join(dst, dir, "outside", "pwned")); err != nil {
+		t.Errorf("a/pwned not extracted inside of dst: %s", err)
+	}
+
+	// Relative symlinks leaving dst are refused
+	stream = testTar(t,
+		tarEntry{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+		tarEntry{Name: "b/pwned", Typeflag: tar.TypeReg, Content: "pwned"},
+	)
+	if err := untarDir(stream, dst, nil); err == nil {
+		t.Errorf("b/pwned extracted through a symlink leaving dst")
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("entry was written outside of dst through a symlink: %v", err)
+	}
+}
+
+func TestUntarDir_refused(t *testing.T) {
+	cases := []tarEntry{
+		{Name: "../escape", Typeflag: tar.TypeReg, Content: "x"},
+		{Name: "dir/../../escape", Typeflag: tar.TypeReg, Content: "x"},
+		{Name: "/etc/passwd", Typeflag: tar.TypeReg, Content: "x"},
+	}
+	for _, entry := range cases {
+		dir, err := ioutil.TempDir("", "untar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = untarDir(testTar(t, entry), filepath.Join(dir, "dst"), nil)
+		os.RemoveAll(dir)
+		if err == nil {
+			t.Errorf("%s: extracted, expected an error", entry.Name)
+		}
+	}
+}
+
+func TestUntarDir_replacesSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	victim := filepath.Join(dir, "victim")
+	if err := ioutil.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := testTar(t,
+		tarEntry{Name: "f", Typeflag: tar.TypeSymlink, Linkname: victim},
+		tarEntry{Name: "f", Typeflag: tar.TypeReg, Content: "overwritten"},
+	)
+	if err := untarDir(stream, filepath.Join(dir, "dst"), nil); err != nil {
+		t.Fatalf("untarDir: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(victim); string(content) != "original" {
+		t.Errorf("file written through a symlink: %q", content)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	cases := []struct {
+		rel     string
+		exclude []string
+		want    bool
+	}{
+		{"a/b/c", nil, false},
+		{"a/b/c", []string{"a"}, true},
+		{"a/b/c", []string{"/a/b/"}, true},
+		{"a/b/c", []string{"c"}, true},
+		{"a/b/c", []string{"*.log"}, false},
+		{"a/b/c.log", []string{"*.log"}, true},
+		{"a/b/c", []string{"a/*/c"}, true},
+		{"ab", []string{"a"}, false},
+	}
+	for _, c := range cases {
+		if got := isExcluded(c.rel, c.exclude); got != c.want {
+			t.Errorf("isExcluded(%q, %q) = %v, want %v", c.rel, c.exclude, got, c.want)
+		}
+	}
+}
+
+// testFileDriver is a MockDriver that pushes files through the driver, like
+// the LXD driver does.
+type testFileDriver struct {
+	*MockDriver
+	pushed []*ContainerFile
+}
+
+func (d *testFileDriver) PushFile(ctx context.Context, name string, file *ContainerFile) error {
+	d.pushed = append(d.pushed, file)
+	return nil
+}
+
+func (d *testFileDriver) PullFile(ctx context.Context, name string, path string, w io.Writer) error {
+	return nil
+}
+
+// testFileInfo is file info that doesn't come from the host filesystem.
+type testFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi testFileInfo) Mode() os.FileMode { return fi.mode }
+func (fi testFileInfo) Sys() interface{}  { return nil }
+
+func TestUpload(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	hostFile := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(hostFile, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(hostFile, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	hostInfo, err := os.Stat(hostFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var otherInfo os.FileInfo = testFileInfo{hostInfo, 0640 | os.ModeSticky}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	dst := filepath.Join(rootfs, "tmp", "script")
+	cases := []struct {
+		name  string
+		fi    *os.FileInfo
+		uid   int
+		gid   int
+		chmod string
+	}{
+		{"host file", &hostInfo, os.Getuid(), os.Getgid(), "4755"},
+		{"other file", &otherInfo, 0, 0, "1640"},
+		{"no file info", nil, 0, 0, ""},
+	}
+	for _, c := range cases {
+		driver := new(MockDriver)
+		comm := &LxcAttachCommunicator{ContainerName: "packer", RootFs: rootfs, Driver: driver}
+		if err := comm.Upload("/tmp/script", strings.NewReader("#!/bin/sh\n"), c.fi); err != nil {
+			t.Fatalf("%s: Upload: %s", c.name, err)
+		}
+		want := [][]string{{"tee", dst}, {"chown", fmt.Sprintf("%d:%d", c.uid, c.gid), dst}}
+		if c.chmod != "" {
+			want = append(want, []string{"chmod", c.chmod, dst})
+		}
+		if !reflect.DeepEqual(driver.SudoCommands, want) {
+			t.Errorf("%s: commands = %q, want %q", c.name, driver.SudoCommands, want)
+		}
+
+		files := &testFileDriver{MockDriver: new(MockDriver)}
+		comm.Driver = files
+		if err := comm.Upload("/tmp/script", strings.NewReader("#!/bin/sh\n"), c.fi); err != nil {
+			t.Fatalf("%s: Upload: %s", c.name, err)
+		}
+		if len(files.pushed) != 1 || files.pushed[0].Uid != c.uid || files.pushed[0].Gid != c.gid {
+			t.Errorf("%s: pushed %#v", c.name, files.pushed)
+		} else if c.chmod != "" && octalMode(files.pushed[0].Mode) != c.chmod {
+			t.Errorf("%s: pushed mode %s, want %s", c.name, octalMode(files.pushed[0].Mode), c.chmod)
+		}
+	}
+}
+
+func TestExecute_attachUser(t *testing.T) {
+	cases := []struct {
+		name string
+		ids  map[string]string
+		uid  int
+		gid  int
+		err  bool
+	}{
+		{"found", map[string]string{"-u": "1000", "-g": "100"}, 1000, 100, false},
+		{"root", map[string]string{"-u": "0", "-g": "0"}, 0, 0, false},
+		{"unknown user", nil, 0, 0, true},
+		{"bad output", map[string]string{"-u": "build", "-g": "100"}, 0, 0, true},
+	}
+	for _, c := range cases {
+		driver := new(MockDriver)
+		driver.setState("packer", "RUNNING")
+		var lookups int
+		ids := c.ids
+		driver.AttachFn = func(name string, cmd *AttachCmd) (int, error) {
+			if len(cmd.Args) != 3 || cmd.Args[0] != "id" || cmd.Args[2] != "build" {
+				return 1, fmt.Errorf("unexpected command %q", cmd.Args)
+			}
+			lookups++
+			id, ok := ids[cmd.Args[1]]
+			if !ok {
+				fmt.Fprintln(cmd.Stderr, "id: 'build': no such user")
+				return 1, nil
+			}
+			fmt.Fprintln(cmd.Stdout, id)
+			return 0, nil
+		}
+		comm := &LxcAttachCommunicator{ContainerName: "packer", Driver: driver}
+		comm.Attach.AttachUser = "build"
+
+		for i := 0; i < 2; i++ {
+			cmd, err := comm.Execute("whoami")
+			if c.err {
+				if err == nil {
+					t.Errorf("%s: expected an error", c.name)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+			if cmd.Uid == nil || cmd.Gid == nil || *cmd.Uid != c.uid || *cmd.Gid != c.gid {
+				t.Errorf("%s: attached as %v:%v, want %d:%d", c.name, cmd.Uid, cmd.Gid, c.uid, c.gid)
+			}
+		}
+		if !c.err && lookups != 2 {
+			t.Errorf("%s: looked up the user %d times, want it cached after one id -u and id -g", c.name, lookups)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package lxc
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/packer/common"
@@ -11,39 +15,163 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// LxcDir is the default lxc_path
 const LxcDir string = "/var/lib/lxc"
 
+// wOK is the W_OK mode of access(2), syscall doesn't define it
+const wOK uint32 = 2
+
+const (
+	DriverLxc    = "lxc"
+	DriverLiblxc = "liblxc"
+	DriverLxd    = "lxd"
+)
+
+const (
+	KeepContainerNever   = "never"
+	KeepContainerOnError = "on_error"
+	KeepContainerAlways  = "always"
+)
+
 type LxcTemplateConfig struct {
 	Name       string
 	Parameters []string
 	EnvVars    []string `mapstructure:"environment_vars"`
 }
 
-type RootFsConfig struct {
+type BackingStoreConfig struct {
+	Type     string
+	FsType   string `mapstructure:"fstype"`
+	FsSize   string `mapstructure:"fssize"`
+	VgName   string `mapstructure:"vgname"`
+	LvName   string `mapstructure:"lvname"`
+	ThinPool string `mapstructure:"thinpool"`
+	ZfsRoot  string `mapstructure:"zfsroot"`
+	RbdName  string `mapstructure:"rbdname"`
+	RbdPool  string `mapstructure:"rbdpool"`
+	Dir      string
+}
+
+// DownloadImageConfig selects an image of the lxc download template. The
+// image can be read from a pre-populated download cache to build offline.
+type DownloadImageConfig struct {
+	Dist       string
+	Release    string
+	Arch       string
+	Variant    string
+	Server     string
+	Keyserver  string
+	NoValidate bool   `mapstructure:"no_validate"`
+	CacheDir   string `mapstructure:"cache_dir"`
+}
+
+// Template returns the download template creating the image.
+func (c DownloadImageConfig) Template() LxcTemplateConfig {
+	template := LxcTemplateConfig{Name: "download"}
+	for _, option := range [][]string{
+		{"--dist", c.Dist},
+		{"--release", c.Release},
+		{"--arch", c.Arch},
+		{"--variant", c.Variant},
+		{"--server", c.Server},
+		{"--keyserver", c.Keyserver},
+	} {
+		if option[1] != "" {
+			template.Parameters = append(template.Parameters, option...)
+		}
+	}
+	if c.NoValidate {
+		template.Parameters = append(template.Parameters, "--no-validate")
+	}
+	if c.CacheDir != "" {
+		// Use the cached image even if it expired, instead of downloading it
+		template.Parameters = append(template.Parameters, "--force-cache")
+		template.EnvVars = []string{"LXC_CACHE_PATH=" + c.CacheDir}
+	}
+	return template
+}
+
+type SourceContainerConfig struct {
+	Name     string
+	Snapshot bool
+}
+
+// SourceOciConfig is an OCI image layout or docker save archive, a directory
+// or a tar archive, to build the container from.
+type SourceOciConfig struct {
+	Path       string
+	Ref        string
 	ConfigFile string `mapstructure:"config"`
-	Archive    string
+}
+
+type RootFsConfig struct {
+	ConfigFile   string `mapstructure:"config"`
+	Archive      string
+	Checksum     string
+	ChecksumType string `mapstructure:"checksum_type"`
+}
+
+// Download reports whether the archive is fetched through the Packer cache
+// instead of being read in place.
+func (c RootFsConfig) Download() bool {
+	return strings.Contains(c.Archive, "://") || c.Checksum != "" || c.ChecksumType != ""
+}
+
+type AttachConfig struct {
+	AttachUser     string   `mapstructure:"attach_user"`
+	AttachUid      *int     `mapstructure:"attach_uid"`
+	AttachGid      *int     `mapstructure:"attach_gid"`
+	AttachClearEnv bool     `mapstructure:"attach_clear_env"`
+	AttachEnv      []string `mapstructure:"attach_env"`
+	AttachShell    string   `mapstructure:"attach_shell"`
 }
 
 type Config struct {
-	common.PackerConfig `mapstructure:",squash"`
-	ConfigFile          string            `mapstructure:"config_file"`
-	OutputDir           string            `mapstructure:"output_directory"`
-	ExportConfig        ExportConfig      `mapstructure:"export_config"`
-	SidediskFolders     []SidediskFolder  `mapstructure:"sidedisks"`
-	ContainerName       string            `mapstructure:"container_name"`
-	CommandWrapper      string            `mapstructure:"command_wrapper"`
-	RawInitTimeout      string            `mapstructure:"init_timeout"`
-	LxcTemplate         LxcTemplateConfig `mapstructure:"lxc_template"`
-	RootFs              RootFsConfig      `mapstructure:"rootfs"`
-	TargetRunlevel      int               `mapstructure:"target_runlevel"`
-	InitTimeout         time.Duration
+	common.PackerConfig  `mapstructure:",squash"`
+	AttachConfig         `mapstructure:",squash"`
+	ConfigFile           string                `mapstructure:"config_file"`
+	OutputDir            string                `mapstructure:"output_directory"`
+	DiagnosticsDir       string                `mapstructure:"diagnostics_directory"`
+	ExportConfig         ExportConfig          `mapstructure:"export_config"`
+	SidediskFolders      []SidediskFolder      `mapstructure:"sidedisks"`
+	ContainerName        string                `mapstructure:"container_name"`
+	Driver               string                `mapstructure:"driver"`
+	LxcPath              string                `mapstructure:"lxc_path"`
+	LxdSocket            string                `mapstructure:"lxd_socket"`
+	KeepContainer        string                `mapstructure:"keep_container"`
+	KeepLogs             bool                  `mapstructure:"keep_logs"`
+	CommandWrapper       string                `mapstructure:"command_wrapper"`
+	RawInitTimeout       string                `mapstructure:"init_timeout"`
+	LxcTemplate          LxcTemplateConfig     `mapstructure:"lxc_template"`
+	DownloadImage        DownloadImageConfig   `mapstructure:"download_image"`
+	TemplateCache        bool                  `mapstructure:"template_cache"`
+	TemplateCacheRefresh bool                  `mapstructure:"template_cache_refresh"`
+	BackingStore         BackingStoreConfig    `mapstructure:"backing_store"`
+	RootFs               RootFsConfig          `mapstructure:"rootfs"`
+	SourceContainer      SourceContainerConfig `mapstructure:"source_container"`
+	SourceOci            SourceOciConfig       `mapstructure:"source_oci"`
+	TargetRunlevel       int                   `mapstructure:"target_runlevel"`
+	WaitStrategy         string                `mapstructure:"wait_strategy"`
+	WaitAcceptDegraded   bool                  `mapstructure:"wait_accept_degraded"`
+	WaitOpenRCRunlevel   string                `mapstructure:"wait_openrc_runlevel"`
+	WaitFile             string                `mapstructure:"wait_file"`
+	WaitCommand          string                `mapstructure:"wait_command"`
+	WaitCommandExitCode  int                   `mapstructure:"wait_command_exit_code"`
+	WaitCommandOutput    string                `mapstructure:"wait_command_output"`
+	NetworkWaitIPv4      bool                  `mapstructure:"network_wait_ipv4"`
+	NetworkWaitIPv6      bool                  `mapstructure:"network_wait_ipv6"`
+	NetworkInterface     string                `mapstructure:"network_interface"`
+	RawNetworkTimeout    string                `mapstructure:"network_timeout"`
+	InitTimeout          time.Duration
+	NetworkTimeout       time.Duration
 
 	ctx interpolate.Context
 }
 
 type ExportConfig struct {
-	Filename string
-	Folders  []ExportFolder `mapstructure:"folders"`
+	Filename   string
+	Folders    []ExportFolder `mapstructure:"folders"`
+	ImageAlias string         `mapstructure:"image_alias"`
 }
 
 type ExportFolder struct {
@@ -51,9 +179,31 @@ type ExportFolder struct {
 	Dest string
 }
 
+const (
+	SidediskArchive = "archive"
+	SidediskCopy    = "copy"
+	SidediskBind    = "bind"
+)
+
+// SidediskFolder is content loaded into the container before it is started,
+// an archive or a copy of a host directory in the rootfs, or a bind mount of
+// a host directory. Persist says whether it stays in the exported image.
 type SidediskFolder struct {
-	Archive string
-	Dest string
+	Type     string
+	Archive  string
+	Source   string
+	Dest     string
+	ReadOnly bool `mapstructure:"read_only"`
+	Persist  *bool
+}
+
+// Persistent reports whether the sidedisk is part of the exported image,
+// which archives and copies are unless persist is false.
+func (s SidediskFolder) Persistent() bool {
+	if s.Persist != nil {
+		return *s.Persist
+	}
+	return s.Type != SidediskBind
 }
 
 func NewConfig(raws ...interface{}) (*Config, error) {
@@ -75,10 +225,113 @@ func NewConfig(raws ...interface{}) (*Config, error) {
 		c.OutputDir = fmt.Sprintf("output-%s", c.PackerBuildName)
 	}
 
+	if c.DiagnosticsDir == "" {
+		c.DiagnosticsDir = fmt.Sprintf("diagnostics-%s", c.PackerBuildName)
+	}
+
 	if c.ContainerName == "" {
 		c.ContainerName = fmt.Sprintf("packer-%s", c.PackerBuildName)
 	}
 
+	if c.Driver == "" {
+		c.Driver = DriverLxc
+	}
+
+	if c.DownloadImage != (DownloadImageConfig{}) {
+		if c.DownloadImage.Dist == "" || c.DownloadImage.Release == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_image.dist and download_image.release must be set"))
+		}
+		if c.DownloadImage.CacheDir != "" {
+			if !filepath.IsAbs(c.DownloadImage.CacheDir) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_image.cache_dir must be an absolute path: %s", c.DownloadImage.CacheDir))
+			} else if _, err := os.Stat(c.DownloadImage.CacheDir); os.IsNotExist(err) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_image.cache_dir does not exist: %s", c.DownloadImage.CacheDir))
+			}
+			if c.DownloadImage.Arch == "" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_image.arch must be set with download_image.cache_dir"))
+			}
+		}
+		if c.LxcTemplate.Name != "" || c.RootFs != (RootFsConfig{}) || c.SourceContainer.Name != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Cannot build with download_image together with lxc_template, rootfs or source_container"))
+		} else if c.Driver == DriverLxd {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("download_image is not supported with driver %s, set lxc_template.name to an image alias", DriverLxd))
+		} else {
+			c.LxcTemplate = c.DownloadImage.Template()
+		}
+	}
+
+	if c.Driver != DriverLxd && c.ExportConfig.ImageAlias != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("export_config.image_alias is only supported with driver %s", DriverLxd))
+	}
+
+	switch c.Driver {
+	case DriverLxc:
+	case DriverLiblxc:
+		if !liblxcSupported {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("driver %s is not available, the plugin must be built with the liblxc build tag", DriverLiblxc))
+		}
+	case DriverLxd:
+		if c.ExportConfig.ImageAlias == "" {
+			c.ExportConfig.ImageAlias = c.ContainerName
+		}
+		if c.LxcTemplate.Name == "" && c.SourceContainer.Name == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_template.name must be set to an image with driver %s", DriverLxd))
+		}
+		if len(c.LxcTemplate.Parameters) > 0 || len(c.LxcTemplate.EnvVars) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_template parameters and environment_vars are not supported with driver %s", DriverLxd))
+		}
+		if c.RootFs != (RootFsConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootfs is not supported with driver %s", DriverLxd))
+		}
+		if len(c.SidediskFolders) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks are not supported with driver %s", DriverLxd))
+		}
+		if len(c.ExportConfig.Folders) > 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("export_config.folders is not supported with driver %s", DriverLxd))
+		}
+		if c.LxcPath != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_path is not supported with driver %s", DriverLxd))
+		}
+		if c.BackingStore != (BackingStoreConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("backing_store is not supported with driver %s", DriverLxd))
+		}
+		if c.SourceOci != (SourceOciConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_oci is not supported with driver %s", DriverLxd))
+		}
+		if c.AttachClearEnv {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("attach_clear_env is not supported with driver %s", DriverLxd))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("driver must be one of %s, %s or %s", DriverLxc, DriverLiblxc, DriverLxd))
+	}
+
+	// The default lxc path is left for lxc to check, it may not exist
+	// before the first container is created.
+	if c.LxcPath == "" {
+		c.LxcPath = LxcDir
+	} else if !filepath.IsAbs(c.LxcPath) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_path must be an absolute path: %s", c.LxcPath))
+	} else if c.Driver != DriverLxd {
+		if fi, err := os.Stat(c.LxcPath); err != nil && !os.IsPermission(err) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error reading lxc_path: %s", err))
+		} else if err == nil && !fi.IsDir() {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_path is not a directory: %s", c.LxcPath))
+		} else if c.Driver == DriverLiblxc && syscall.Access(c.LxcPath, wOK) != nil {
+			// liblxc writes to the lxc path from this process
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("lxc_path %s is not writable by this user, needed by driver %s", c.LxcPath, DriverLiblxc))
+		}
+	}
+
+	if c.KeepContainer == "" {
+		c.KeepContainer = KeepContainerNever
+	}
+
+	switch c.KeepContainer {
+	case KeepContainerNever, KeepContainerOnError, KeepContainerAlways:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("keep_container must be one of %s, %s or %s", KeepContainerNever, KeepContainerOnError, KeepContainerAlways))
+	}
+
 	if c.CommandWrapper == "" {
 		c.CommandWrapper = "{{.Command}}"
 	}
@@ -92,13 +345,193 @@ func NewConfig(raws ...interface{}) (*Config, error) {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed parsing init_timeout: %s", err))
 	}
 
+	if c.RawNetworkTimeout == "" {
+		c.RawNetworkTimeout = "60s"
+	}
+
+	c.NetworkTimeout, err = time.ParseDuration(c.RawNetworkTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed parsing network_timeout: %s", err))
+	}
+
+	if c.WaitStrategy == "" {
+		c.WaitStrategy = WaitStrategyRunlevel
+	}
+
+	if c.WaitOpenRCRunlevel == "" {
+		c.WaitOpenRCRunlevel = "default"
+	}
+
+	switch c.WaitStrategy {
+	case WaitStrategyAuto, WaitStrategyRunlevel, WaitStrategySystemd, WaitStrategyOpenRC:
+	case WaitStrategyFileExists:
+		if c.WaitFile == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("wait_file must be set for wait_strategy %s", c.WaitStrategy))
+		}
+	case WaitStrategyCommand:
+		if c.WaitCommand == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("wait_command must be set for wait_strategy %s", c.WaitStrategy))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unknown wait_strategy: %s", c.WaitStrategy))
+	}
+
 	if c.LxcTemplate.Name != "" && c.RootFs != (RootFsConfig{}) {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Cannot build with both lxc_template and rootfs configuration options"))
 	}
 
+	if c.SourceOci != (SourceOciConfig{}) {
+		if c.LxcTemplate.Name != "" || c.RootFs != (RootFsConfig{}) || c.SourceContainer.Name != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Cannot build with source_oci together with lxc_template, download_image, rootfs or source_container"))
+		}
+		if c.SourceOci.Path == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_oci.path must be set"))
+		} else if _, err := os.Stat(c.SourceOci.Path); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error reading source_oci.path: %s", err))
+		}
+		if c.SourceOci.ConfigFile == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_oci.config must be set to the lxc config of the container"))
+		}
+		if c.BackingStore != (BackingStoreConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("backing_store cannot be used with source_oci, the layers are always extracted to a directory"))
+		}
+	}
+
+	if c.RootFs.Download() {
+		url, err := common.DownloadableURL(c.RootFs.Archive)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Failed to parse rootfs.archive: %s", err))
+		} else {
+			c.RootFs.Archive = url
+		}
+
+		c.RootFs.Checksum = strings.ToLower(c.RootFs.Checksum)
+		c.RootFs.ChecksumType = strings.ToLower(c.RootFs.ChecksumType)
+		if c.RootFs.ChecksumType == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootfs.checksum_type must be set for a rootfs.archive URL, use none to skip the verification"))
+		} else if c.RootFs.ChecksumType != "none" {
+			if h := common.HashForType(c.RootFs.ChecksumType); h == nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported rootfs.checksum_type: %s", c.RootFs.ChecksumType))
+			} else if c.RootFs.Checksum == "" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("rootfs.checksum must be set with rootfs.checksum_type %s", c.RootFs.ChecksumType))
+			}
+		}
+	}
+
+	if c.SourceContainer.Name != "" {
+		if c.LxcTemplate.Name != "" || c.RootFs != (RootFsConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Cannot build with source_container together with lxc_template or rootfs"))
+		}
+		if c.SourceContainer.Name == c.ContainerName {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_container must not be the build container %s", c.ContainerName))
+		}
+		if c.BackingStore != (BackingStoreConfig{Type: c.BackingStore.Type, FsSize: c.BackingStore.FsSize}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Only the type and fssize of backing_store can be used with source_container"))
+		}
+	} else if c.SourceContainer.Snapshot {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_container.snapshot needs source_container.name"))
+	}
+
+	if c.BackingStore != (BackingStoreConfig{}) {
+		switch c.BackingStore.Type {
+		case "dir", "btrfs", "zfs", "lvm", "loop", "rbd", "overlay", "best":
+		case "":
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("backing_store.type must be set"))
+		default:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unknown backing_store.type: %s", c.BackingStore.Type))
+		}
+		if c.RootFs != (RootFsConfig{}) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("backing_store cannot be used with rootfs, the archive is always extracted to a directory"))
+		}
+	}
+
+	if c.TemplateCache {
+		if c.LxcTemplate.Name == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("template_cache needs lxc_template.name"))
+		}
+		if c.Driver == DriverLxd {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("template_cache is not supported with driver %s, LXD caches its images", DriverLxd))
+		}
+		if c.BackingStore.Type != "" && c.BackingStore.Type != "dir" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("template_cache only supports the dir backing_store"))
+		}
+	} else if c.TemplateCacheRefresh {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("template_cache_refresh needs template_cache"))
+	}
+
+	for i := range c.SidediskFolders {
+		sidedisk := &c.SidediskFolders[i]
+		if sidedisk.Type == "" {
+			sidedisk.Type = SidediskArchive
+		}
+		if sidedisk.Dest == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].dest must be set", i))
+		}
+		switch sidedisk.Type {
+		case SidediskArchive:
+			if sidedisk.Archive == "" || sidedisk.Source != "" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d] of type %s needs archive and no source", i, sidedisk.Type))
+			}
+		case SidediskCopy, SidediskBind:
+			if sidedisk.Source == "" || sidedisk.Archive != "" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d] of type %s needs source and no archive", i, sidedisk.Type))
+			} else if fi, err := os.Stat(sidedisk.Source); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error reading sidedisks[%d].source: %s", i, err))
+			} else if !fi.IsDir() || !filepath.IsAbs(sidedisk.Source) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].source must be an absolute path to a directory: %s", i, sidedisk.Source))
+			}
+		default:
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].type must be one of %s, %s or %s", i, SidediskArchive, SidediskCopy, SidediskBind))
+		}
+		if sidedisk.ReadOnly && sidedisk.Type != SidediskBind {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].read_only is only supported for type %s", i, SidediskBind))
+		}
+		if !sidedisk.Persistent() && filepath.Clean("/"+sidedisk.Dest) == "/" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].dest must not be / unless it persists", i))
+		}
+		if sidedisk.Type == SidediskBind && sidedisk.Persistent() {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d] of type %s is never part of the exported image, use type %s to persist it", i, SidediskBind, SidediskCopy))
+		}
+	}
+
+	// A sidedisk that doesn't persist is removed with everything below its
+	// dest, which must not take other sidedisks with it
+	for i, sidedisk := range c.SidediskFolders {
+		if sidedisk.Type == SidediskBind {
+			continue
+		}
+		for j := i + 1; j < len(c.SidediskFolders); j++ {
+			other := c.SidediskFolders[j]
+			if other.Type == SidediskBind || (sidedisk.Persistent() && other.Persistent()) {
+				continue
+			}
+			if pathsOverlap(sidedisk.Dest, other.Dest) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("sidedisks[%d].dest and sidedisks[%d].dest overlap, which is only supported when both persist", i, j))
+			}
+		}
+	}
+
+	if c.AttachUser != "" && (c.AttachUid != nil || c.AttachGid != nil) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Cannot use attach_user together with attach_uid or attach_gid"))
+	}
+
+	for _, env := range c.AttachEnv {
+		if !strings.Contains(env, "=") {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("attach_env must be in the form KEY=VALUE: %s", env))
+		}
+	}
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return nil, errs
 	}
 
 	return &c, nil
 }
+
+// pathsOverlap reports whether two paths in the container are the same or
+// one is below the other.
+func pathsOverlap(a, b string) bool {
+	a = filepath.Clean("/" + a)
+	b = filepath.Clean("/" + b)
+	return a == b || strings.HasPrefix(a, strings.TrimSuffix(b, "/")+"/") || strings.HasPrefix(b, strings.TrimSuffix(a, "/")+"/")
+}
@@ -0,0 +1,228 @@
+package lxc
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(raw map[string]interface{})
+		err    string
+	}{
+		{"valid", func(raw map[string]interface{}) {}, ""},
+		{"unknown key", func(raw map[string]interface{}) { raw["unknown"] = true }, "unknown"},
+		{"driver", func(raw map[string]interface{}) { raw["driver"] = "docker" }, "driver must be one of"},
+		{"lxd with rootfs", func(raw map[string]interface{}) {
+			raw["driver"] = "lxd"
+			delete(raw, "lxc_path")
+		}, "rootfs is not supported with driver lxd"},
+		{"lxd with attach_clear_env", func(raw map[string]interface{}) {
+			raw["driver"] = "lxd"
+			raw["attach_clear_env"] = true
+		}, "attach_clear_env is not supported"},
+		{"image_alias without lxd", func(raw map[string]interface{}) {
+			raw["export_config"] = map[string]interface{}{"image_alias": "base"}
+		}, "export_config.image_alias is only supported with driver lxd"},
+		{"relative lxc_path", func(raw map[string]interface{}) { raw["lxc_path"] = "lxc" }, "lxc_path must be an absolute path"},
+		{"missing lxc_path", func(raw map[string]interface{}) { raw["lxc_path"] = "/nonexistent/lxc" }, "Error reading lxc_path"},
+		{"keep_container", func(raw map[string]interface{}) { raw["keep_container"] = "sometimes" }, "keep_container must be one of"},
+		{"attach_user with attach_uid", func(raw map[string]interface{}) {
+			raw["attach_user"] = "build"
+			raw["attach_uid"] = 1000
+		}, "Cannot use attach_user together with attach_uid"},
+		{"attach_env", func(raw map[string]interface{}) { raw["attach_env"] = []string{"FOO"} }, "attach_env must be in the form KEY=VALUE"},
+		{"wait_strategy", func(raw map[string]interface{}) { raw["wait_strategy"] = "sleep" }, "Unknown wait_strategy"},
+		{"wait_file", func(raw map[string]interface{}) { raw["wait_strategy"] = "file_exists" }, "wait_file must be set"},
+		{"wait_command", func(raw map[string]interface{}) { raw["wait_strategy"] = "command" }, "wait_command must be set"},
+		{"init_timeout", func(raw map[string]interface{}) { raw["init_timeout"] = "soon" }, "Failed parsing init_timeout"},
+		{"download_image release", func(raw map[string]interface{}) {
+			delete(raw, "rootfs")
+			raw["download_image"] = map[string]interface{}{"dist": "debian"}
+		}, "download_image.dist and download_image.release must be set"},
+		{"download_image with rootfs", func(raw map[string]interface{}) {
+			raw["download_image"] = map[string]interface{}{"dist": "debian", "release": "stretch"}
+		}, "Cannot build with download_image together with"},
+		{"download_image relative cache_dir", func(raw map[string]interface{}) {
+			delete(raw, "rootfs")
+			raw["download_image"] = map[string]interface{}{"dist": "debian", "release": "stretch", "arch": "amd64", "cache_dir": "cache"}
+		}, "download_image.cache_dir must be an absolute path"},
+		{"download_image missing cache_dir", func(raw map[string]interface{}) {
+			delete(raw, "rootfs")
+			raw["download_image"] = map[string]interface{}{"dist": "debian", "release": "stretch", "arch": "amd64", "cache_dir": "/nonexistent/cache"}
+		}, "download_image.cache_dir does not exist"},
+		{"download_image cache_dir without arch", func(raw map[string]interface{}) {
+			delete(raw, "rootfs")
+			raw["download_image"] = map[string]interface{}{"dist": "debian", "release": "stretch", "cache_dir": os.TempDir()}
+		}, "download_image.arch must be set with download_image.cache_dir"},
+		{"template and rootfs", func(raw map[string]interface{}) {
+			raw["lxc_template"] = map[string]interface{}{"name": "debian"}
+		}, "Cannot build with both lxc_template and rootfs"},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		c.modify(raw)
+
+		_, err := NewConfig(raw)
+		if c.err == "" && err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestNewConfig_defaults(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	delete(raw, "container_name")
+	delete(raw, "init_timeout")
+	delete(raw, "lxc_path")
+
+	c, err := NewConfig(raw)
+	if err != nil {
+		t.Fatalf("NewConfig: %s", err)
+	}
+	if c.Driver != DriverLxc || c.ContainerName != "packer-test" || c.InitTimeout != 20*time.Second {
+		t.Errorf("unexpected defaults: driver %s, container_name %s, init_timeout %s", c.Driver, c.ContainerName, c.InitTimeout)
+	}
+	if c.WaitStrategy != WaitStrategyRunlevel || c.WaitOpenRCRunlevel != "default" {
+		t.Errorf("unexpected defaults: wait_strategy %s, wait_openrc_runlevel %s", c.WaitStrategy, c.WaitOpenRCRunlevel)
+	}
+	if c.KeepContainer != KeepContainerNever {
+		t.Errorf("unexpected default keep_container: %s", c.KeepContainer)
+	}
+	if c.LxcPath != LxcDir {
+		t.Errorf("unexpected default lxc_path: %s", c.LxcPath)
+	}
+}
+
+func TestNewConfig_sidedisks(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		sidedisks []map[string]interface{}
+		err       string
+	}{
+		{
+			[]map[string]interface{}{
+				{"type": "copy", "source": dir, "dest": "/opt"},
+				{"type": "copy", "source": dir, "dest": "/opt/app"},
+			},
+			"",
+		},
+		{
+			[]map[string]interface{}{
+				{"type": "copy", "source": dir, "dest": "/opt/deps", "persist": false},
+				{"type": "bind", "source": dir, "dest": "/opt/deps"},
+			},
+			"",
+		},
+		{
+			[]map[string]interface{}{
+				{"type": "copy", "source": dir, "dest": "/opt"},
+				{"type": "copy", "source": dir, "dest": "/opt/deps/", "persist": false},
+			},
+			"sidedisks[0].dest and sidedisks[1].dest overlap",
+		},
+		{
+			[]map[string]interface{}{
+				{"type": "copy", "source": dir, "dest": "opt/deps", "persist": false},
+				{"type": "copy", "source": dir, "dest": "/opt/deps"},
+			},
+			"sidedisks[0].dest and sidedisks[1].dest overlap",
+		},
+		{
+			[]map[string]interface{}{
+				{"type": "copy", "source": dir, "dest": "/", "persist": false},
+			},
+			"sidedisks[0].dest must not be /",
+		},
+	}
+	for i, c := range cases {
+		buildDir := testDir(t)
+		defer os.RemoveAll(buildDir)
+		raw := testConfig(t, buildDir)
+		raw["sidedisks"] = c.sidedisks
+		_, err := NewConfig(raw)
+		if c.err == "" && err != nil {
+			t.Errorf("case %d: %s", i, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("case %d: expected %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestDownloadImageConfig_Template(t *testing.T) {
+	cases := []struct {
+		name   string
+		config DownloadImageConfig
+		want   LxcTemplateConfig
+	}{
+		{
+			"release",
+			DownloadImageConfig{Dist: "debian", Release: "stretch"},
+			LxcTemplateConfig{Name: "download", Parameters: []string{"--dist", "debian", "--release", "stretch"}},
+		},
+		{
+			"all options",
+			DownloadImageConfig{Dist: "alpine", Release: "3.8", Arch: "amd64", Variant: "default", Server: "images.example.com", Keyserver: "hkp://keys.example.com", NoValidate: true},
+			LxcTemplateConfig{Name: "download", Parameters: []string{
+				"--dist", "alpine", "--release", "3.8", "--arch", "amd64", "--variant", "default",
+				"--server", "images.example.com", "--keyserver", "hkp://keys.example.com", "--no-validate",
+			}},
+		},
+		{
+			"offline",
+			DownloadImageConfig{Dist: "debian", Release: "stretch", Arch: "amd64", CacheDir: "/srv/lxc-cache"},
+			LxcTemplateConfig{
+				Name:       "download",
+				Parameters: []string{"--dist", "debian", "--release", "stretch", "--arch", "amd64", "--force-cache"},
+				EnvVars:    []string{"LXC_CACHE_PATH=/srv/lxc-cache"},
+			},
+		},
+	}
+	for _, c := range cases {
+		if got := c.config.Template(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: template %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNewConfig_downloadImage(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	delete(raw, "rootfs")
+	raw["download_image"] = map[string]interface{}{"dist": "debian", "release": "stretch", "arch": "amd64", "cache_dir": dir}
+
+	c, err := NewConfig(raw)
+	if err != nil {
+		t.Fatalf("NewConfig: %s", err)
+	}
+	if !reflect.DeepEqual(c.LxcTemplate, c.DownloadImage.Template()) {
+		t.Errorf("lxc_template %#v isn't the download template", c.LxcTemplate)
+	}
+
+	// The cache path reaches lxc-create through sudo
+	var commands []string
+	driver := &LxcDriver{CmdWrapper: testCommands(&commands)}
+	if err := driver.Create(context.Background(), "packer", CreateOptions{Template: c.LxcTemplate}); err != nil {
+		t.Fatal(err)
+	}
+	want := "sudo LXC_CACHE_PATH=" + dir + " lxc-create -n packer -t download -- --dist debian --release stretch --arch amd64 --force-cache"
+	if len(commands) != 1 || commands[0] != want {
+		t.Errorf("commands %q, want %q", commands, want)
+	}
+}
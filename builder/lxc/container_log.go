@@ -0,0 +1,90 @@
+package lxc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the directory in the output directory the lxc-start and console
+// logs of the container are written to.
+const logDirName = "logs"
+
+// logFollower follows log files written by root and copies every line to the
+// packer log, so the container boot can be debugged with PACKER_LOG.
+type logFollower struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func followLogs(ctx context.Context, driver Driver, paths ...string) *logFollower {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	f := &logFollower{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		err := driver.SudoCommand(ctx, &HostCmd{
+			Args:   append([]string{"tail", "-n", "+1", "-F"}, paths...),
+			Stdout: pw,
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error following container logs: %s", err)
+		}
+		pw.Close()
+	}()
+
+	go func() {
+		defer close(f.done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			log.Printf("[container] %s", scanner.Text())
+		}
+	}()
+
+	return f
+}
+
+func (f *logFollower) Stop() {
+	f.cancel()
+	<-f.done
+}
+
+// tailLog returns the last n lines of a log file written by root.
+func tailLog(driver Driver, path string, n int) ([]string, error) {
+	var stdout bytes.Buffer
+	err := driver.SudoCommand(context.Background(), &HostCmd{
+		Args:   []string{"tail", "-n", fmt.Sprintf("%d", n), path},
+		Stdout: &stdout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimRight(stdout.String(), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// logDir returns the absolute path of the container log directory.
+func logDir(config *Config) (string, error) {
+	return filepath.Abs(filepath.Join(config.OutputDir, logDirName))
+}
+
+// reclaimLogs hands the log files, which lxc-start created as root, over to
+// the user running packer.
+func reclaimLogs(driver Driver, dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	return sudo(context.Background(), driver, "chown", "-R", owner, dir)
+}
@@ -0,0 +1,113 @@
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Number of consecutive polls the container has to be seen stopped before it
+// is considered dead, so that a reboot during provisioning is not fatal.
+const maxStoppedPolls = 3
+
+// containerWatcher polls the state of a running container with lxc-info and
+// cancels its context as soon as the container stops unexpectedly.
+type containerWatcher struct {
+	driver  Driver
+	name    string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	stopped chan struct{}
+
+	state        string
+	stoppedPolls int
+
+	l   sync.Mutex
+	err error
+}
+
+// watchContainer starts watching the named container until Stop is called
+// or parent is cancelled.
+func watchContainer(parent context.Context, driver Driver, name string) *containerWatcher {
+	ctx, cancel := context.WithCancel(parent)
+	w := &containerWatcher{
+		driver:  driver,
+		name:    name,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Context returns a context that is cancelled when the container stopped,
+// the watcher was stopped or the parent context was cancelled. Commands that
+// run inside of the container should use it.
+func (w *containerWatcher) Context() context.Context {
+	return w.ctx
+}
+
+// Stopped is closed when the container left the RUNNING state unexpectedly.
+func (w *containerWatcher) Stopped() <-chan struct{} {
+	return w.stopped
+}
+
+// Err returns the reason the container stopped, or nil if it didn't.
+func (w *containerWatcher) Err() error {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return w.err
+}
+
+// Stop stops watching the container.
+func (w *containerWatcher) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *containerWatcher) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
+
+		info, err := w.driver.Info(w.ctx, w.name)
+		if err != nil {
+			if w.ctx.Err() == nil {
+				log.Printf("Error reading state of container %s: %s", w.name, err)
+			}
+			continue
+		}
+
+		state := info.State
+		if state != w.state {
+			log.Printf("Container %s is %s", w.name, state)
+			w.state = state
+		}
+
+		switch state {
+		case "STOPPED", "ABORTING":
+			w.stoppedPolls++
+		default:
+			w.stoppedPolls = 0
+		}
+
+		if w.stoppedPolls >= maxStoppedPolls {
+			w.l.Lock()
+			w.err = fmt.Errorf("Container stopped unexpectedly, state: %s", state)
+			w.l.Unlock()
+			close(w.stopped)
+			w.cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package lxc
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Driver is the interface to LXC on the host. Every command the builder runs
+// goes through it, so the steps can be tested with MockDriver on machines
+// without LXC.
+type Driver interface {
+	// Create creates a container from an lxc template.
+	Create(ctx context.Context, name string, opts CreateOptions) error
+
+	// Clone copies the stopped container source to a new container, without
+	// changing the source.
+	Clone(ctx context.Context, source string, name string, opts CloneOptions) error
+
+	// Start starts a stopped container in the background.
+	Start(ctx context.Context, name string, opts StartOptions) error
+
+	// Stop stops a running container.
+	Stop(ctx context.Context, name string) error
+
+	// Destroy stops and deletes a container.
+	Destroy(ctx context.Context, name string) error
+
+	// Attach runs a command inside of a running container and returns its
+	// exit status. A non-zero exit status is not an error.
+	Attach(ctx context.Context, name string, cmd *AttachCmd) (int, error)
+
+	// Info returns the state and addresses of a container. It fails if the
+	// container doesn't exist.
+	Info(ctx context.Context, name string) (*ContainerInfo, error)
+
+	// Version returns the version of LXC.
+	Version(ctx context.Context) (string, error)
+
+	// SudoCommand runs any other command on the host as root, like tar or
+	// mkdir in the directory of a container.
+	SudoCommand(ctx context.Context, cmd *HostCmd) error
+}
+
+// FileDriver is implemented by drivers that copy files in and out of a
+// container themselves, for containers whose rootfs is not on the host.
+type FileDriver interface {
+	// PushFile writes a file, directory or symlink into a container.
+	PushFile(ctx context.Context, name string, file *ContainerFile) error
+
+	// PullFile copies the content of a file in a container to w.
+	PullFile(ctx context.Context, name string, path string, w io.Writer) error
+}
+
+// ImageDriver is implemented by drivers that export a container as an image
+// of their own instead of as a tarball of its rootfs.
+type ImageDriver interface {
+	// Publish creates an image from a stopped container, writes it to w and
+	// returns its fingerprint.
+	Publish(ctx context.Context, name string, opts PublishOptions, w io.Writer) (string, error)
+
+	// DeleteImage removes a published image.
+	DeleteImage(ctx context.Context, fingerprint string) error
+}
+
+// PublishOptions are the options a container is published with. An alias
+// that is already taken is only moved to the new image with Replace.
+type PublishOptions struct {
+	Alias   string
+	Replace bool
+}
+
+// ConfigDriver is implemented by drivers that read the config of a container
+// themselves instead of from its config file on the host.
+type ConfigDriver interface {
+	// ConfigItem returns the value of a key in the config of a container, or
+	// "" if it isn't set.
+	ConfigItem(ctx context.Context, name string, key string) (string, error)
+}
+
+// CreateOptions are the options a container is created with.
+type CreateOptions struct {
+	Template     LxcTemplateConfig
+	BackingStore BackingStoreConfig
+}
+
+// CloneOptions are the options a container is cloned with. Snapshot clones
+// share the rootfs of the source where the backing store allows it.
+type CloneOptions struct {
+	Snapshot     bool
+	BackingStore BackingStoreConfig
+}
+
+// StartOptions are the options a container is started with.
+type StartOptions struct {
+	LogFile     string
+	LogPriority string
+	ConsoleLog  string
+}
+
+// AttachCmd is a command to run inside of a container.
+type AttachCmd struct {
+	Args     []string
+	Uid      *int
+	Gid      *int
+	ClearEnv bool
+	Env      []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// HostCmd is a command to run as root on the host.
+type HostCmd struct {
+	Args []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ContainerFile is a file to write into a container. The type bits of Mode
+// select a regular file, a directory or a symlink, Content is the content of
+// a file or the target of a symlink.
+type ContainerFile struct {
+	Path    string
+	Mode    os.FileMode
+	Uid     int
+	Gid     int
+	Content io.Reader
+}
+
+// ContainerInfo describes a container.
+type ContainerInfo struct {
+	Name  string
+	State string
+	Pid   int
+	IPs   []string
+}
+
+// sudo runs a command as root on the host.
+func sudo(ctx context.Context, driver Driver, args ...string) error {
+	return driver.SudoCommand(ctx, &HostCmd{Args: args})
+}
+
+// sudoCommands runs commands as root on the host, stopping at the first one
+// that fails.
+func sudoCommands(ctx context.Context, driver Driver, commands ...[]string) error {
+	for _, command := range commands {
+		if err := sudo(ctx, driver, command...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newDriver returns the driver named in the config.
+func newDriver(config *Config, wrapper CommandWrapper) (Driver, error) {
+	switch config.Driver {
+	case DriverLiblxc:
+		return newLiblxcDriver(config.LxcPath, wrapper)
+	case DriverLxd:
+		return newLxdDriver(config.LxdSocket, wrapper)
+	default:
+		return &LxcDriver{CmdWrapper: wrapper, LxcPath: config.LxcPath}, nil
+	}
+}
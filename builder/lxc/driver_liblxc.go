@@ -0,0 +1,535 @@
+//go:build liblxc
+// +build liblxc
+
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	lxc "gopkg.in/lxc/go-lxc.v2"
+)
+
+const liblxcSupported = true
+
+// startTimeout is how long Start waits for a container to be RUNNING.
+const startTimeout = 30 * time.Second
+
+// envLock is held while a template runs with its environment variables set
+// on this process. go-lxc has no way to pass an environment to a template,
+// it inherits the one of the process, so concurrent creates would see each
+// other's variables without it.
+var envLock sync.Mutex
+
+var logLevels = map[string]lxc.LogLevel{
+	"TRACE":  lxc.TRACE,
+	"DEBUG":  lxc.DEBUG,
+	"INFO":   lxc.INFO,
+	"NOTICE": lxc.NOTICE,
+	"WARN":   lxc.WARN,
+	"ERROR":  lxc.ERROR,
+	"CRIT":   lxc.CRIT,
+	"ALERT":  lxc.ALERT,
+	"FATAL":  lxc.FATAL,
+}
+
+// LiblxcDriver is a Driver that manages containers through liblxc instead of
+// the lxc-* command line tools. Packer has to run with enough privileges to
+// manage the containers itself. Other commands on the host, like tar, still
+// run with sudo through the embedded LxcDriver.
+type LiblxcDriver struct {
+	LxcDriver
+}
+
+func newLiblxcDriver(lxcPath string, wrapper CommandWrapper) (Driver, error) {
+	return &LiblxcDriver{LxcDriver{CmdWrapper: wrapper, LxcPath: lxcPath}}, nil
+}
+
+func (d *LiblxcDriver) Create(ctx context.Context, name string, opts CreateOptions) error {
+	template := opts.Template
+	options := templateOptions(template)
+	if opts.BackingStore.Type != "" {
+		if opts.BackingStore != (BackingStoreConfig{Type: opts.BackingStore.Type}) {
+			return fmt.Errorf("The liblxc driver only supports the type of backing_store")
+		}
+		if err := options.Backend.Set(opts.BackingStore.Type); err != nil {
+			return fmt.Errorf("Unsupported backing_store.type %s: %s", opts.BackingStore.Type, err)
+		}
+	}
+
+	c, err := d.container(name)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	// Templates are run by liblxc from this process, so they get their
+	// environment from it.
+	envLock.Lock()
+	defer envLock.Unlock()
+	restore, err := setenv(template.EnvVars)
+	defer restore()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Creating container %s from template %s: %#v", name, template.Name, template.Parameters)
+	err = interruptible(ctx, func() error { return c.Create(options) }, func() {
+		log.Printf("Waiting for the template of container %s to finish", name)
+	})
+	if err != nil && err == ctx.Err() {
+		d.destroyInterrupted(c, name)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating container %s: %s", name, err)
+	}
+	return nil
+}
+
+func (d *LiblxcDriver) Clone(ctx context.Context, source string, name string, opts CloneOptions) error {
+	options := lxc.CloneOptions{Snapshot: opts.Snapshot}
+	if opts.BackingStore.Type != "" {
+		if opts.BackingStore != (BackingStoreConfig{Type: opts.BackingStore.Type}) {
+			return fmt.Errorf("The liblxc driver only supports the type of backing_store")
+		}
+		if err := options.Backend.Set(opts.BackingStore.Type); err != nil {
+			return fmt.Errorf("Unsupported backing_store.type %s: %s", opts.BackingStore.Type, err)
+		}
+	}
+
+	c, err := d.container(source)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	log.Printf("Cloning container %s to %s", source, name)
+	err = interruptible(ctx, func() error { return c.Clone(name, options) }, func() {
+		log.Printf("Waiting for the clone of container %s to finish", source)
+	})
+	if err != nil && err == ctx.Err() {
+		if clone, cerr := d.container(name); cerr == nil {
+			d.destroyInterrupted(clone, name)
+			clone.Release()
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Error cloning container %s: %s", source, err)
+	}
+	return nil
+}
+
+func (d *LiblxcDriver) Start(ctx context.Context, name string, opts StartOptions) error {
+	c, err := d.container(name)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	if opts.LogFile != "" {
+		if err := c.SetLogFile(opts.LogFile); err != nil {
+			return fmt.Errorf("Error setting log file: %s", err)
+		}
+	}
+	if level, ok := logLevels[strings.ToUpper(opts.LogPriority)]; ok {
+		if err := c.SetLogLevel(level); err != nil {
+			return fmt.Errorf("Error setting log priority: %s", err)
+		}
+	}
+	if opts.ConsoleLog != "" {
+		if err := c.SetConfigItem("lxc.console.logfile", opts.ConsoleLog); err != nil {
+			return fmt.Errorf("Error setting console log: %s", err)
+		}
+	}
+
+	log.Printf("Starting container %s", name)
+	return interruptible(ctx, func() error {
+		if err := c.Start(); err != nil {
+			return fmt.Errorf("Error starting container %s: %s", name, err)
+		}
+		// Wait in steps, a container stopped in the meantime won't get there
+		deadline := time.Now().Add(startTimeout)
+		for !c.Wait(lxc.RUNNING, time.Second) {
+			if state := c.State(); state == lxc.STOPPED || time.Now().After(deadline) {
+				return fmt.Errorf("Container %s did not reach state RUNNING, state: %s", name, state)
+			}
+		}
+		return nil
+	}, func() {
+		// The handle is busy with the start, the container is stopped
+		// through another one
+		if other, err := d.container(name); err == nil {
+			log.Printf("Stopping container %s, the build was cancelled", name)
+			other.Stop()
+			other.Release()
+		}
+	})
+}
+
+func (d *LiblxcDriver) Stop(ctx context.Context, name string) error {
+	c, err := d.container(name)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	log.Printf("Stopping container %s", name)
+	// There is nothing to interrupt, liblxc kills the container
+	err = interruptible(ctx, c.Stop, func() {})
+	if err != nil && err != ctx.Err() {
+		return fmt.Errorf("Error stopping container %s: %s", name, err)
+	}
+	return err
+}
+
+func (d *LiblxcDriver) Destroy(ctx context.Context, name string) error {
+	c, err := d.container(name)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	log.Printf("Destroying container %s", name)
+	if c.Running() {
+		if err := c.Stop(); err != nil {
+			return fmt.Errorf("Error stopping container %s: %s", name, err)
+		}
+	}
+	if err := c.Destroy(); err != nil {
+		return fmt.Errorf("Error destroying container %s: %s", name, err)
+	}
+	return nil
+}
+
+func (d *LiblxcDriver) Attach(ctx context.Context, name string, cmd *AttachCmd) (int, error) {
+	c, err := d.container(name)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Release()
+
+	options := lxc.DefaultAttachOptions
+	if cmd.Uid != nil {
+		options.UID = *cmd.Uid
+	}
+	if cmd.Gid != nil {
+		options.GID = *cmd.Gid
+	}
+	options.ClearEnv = cmd.ClearEnv
+	options.Env = cmd.Env
+
+	var stdio attachIO
+	defer stdio.Close()
+	if options.StdinFd, err = stdio.Reader(cmd.Stdin); err != nil {
+		return 0, err
+	}
+	if options.StdoutFd, err = stdio.Writer(cmd.Stdout); err != nil {
+		return 0, err
+	}
+	if options.StderrFd, err = stdio.Writer(cmd.Stderr); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Attaching to container %s: %#v", name, cmd.Args)
+	pid, err := c.RunCommandNoWait(cmd.Args, options)
+	if err != nil {
+		return 0, fmt.Errorf("Error attaching to container %s: %s", name, err)
+	}
+
+	// The attached process has its own copies of the descriptors now
+	stdio.CloseChild()
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			process.Signal(syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	processState, err := process.Wait()
+	if err != nil {
+		return 0, err
+	}
+	stdio.Wait()
+
+	if status, ok := processState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return status.ExitStatus(), nil
+	}
+	if !processState.Success() {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (d *LiblxcDriver) Info(ctx context.Context, name string) (*ContainerInfo, error) {
+	c, err := d.container(name)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Release()
+
+	if !c.Defined() {
+		return nil, fmt.Errorf("Container %s doesn't exist", name)
+	}
+
+	info := &ContainerInfo{
+		Name:  name,
+		State: c.State().String(),
+	}
+	if c.Running() {
+		info.Pid = c.InitPid()
+
+		// The container may not have an address yet
+		if ips, err := c.IPAddresses(); err == nil {
+			info.IPs = ips
+		}
+	}
+	return info, nil
+}
+
+func (d *LiblxcDriver) Version(ctx context.Context) (string, error) {
+	return lxc.Version(), nil
+}
+
+func (d *LiblxcDriver) ConfigItem(ctx context.Context, name string, key string) (string, error) {
+	c, err := d.container(name)
+	if err != nil {
+		return "", err
+	}
+	defer c.Release()
+
+	if !c.Defined() {
+		return "", fmt.Errorf("Container %s doesn't exist", name)
+	}
+	// Keys this version of LXC doesn't know have no value either
+	return strings.Join(c.ConfigItem(key), "\n"), nil
+}
+
+func (d *LiblxcDriver) container(name string) (*lxc.Container, error) {
+	var lxcPath []string
+	if d.LxcPath != "" {
+		lxcPath = append(lxcPath, d.LxcPath)
+	}
+
+	c, err := lxc.NewContainer(name, lxcPath...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading container %s: %s", name, err)
+	}
+	return c, nil
+}
+
+// templateOptions converts a template config to the options of liblxc. The
+// download template takes its image and download flags as options instead
+// of as arguments.
+func templateOptions(template LxcTemplateConfig) lxc.TemplateOptions {
+	options := lxc.TemplateOptions{
+		Template: template.Name,
+		Backend:  lxc.Directory,
+	}
+	if template.Name != "download" {
+		options.ExtraArgs = template.Parameters
+		return options
+	}
+
+	params := template.Parameters
+	for i := 0; i < len(params); i++ {
+		var value *string
+		switch params[i] {
+		case "-d", "--dist":
+			value = &options.Distro
+		case "-r", "--release":
+			value = &options.Release
+		case "-a", "--arch":
+			value = &options.Arch
+		case "--variant":
+			value = &options.Variant
+		case "--server":
+			value = &options.Server
+		case "--keyserver":
+			value = &options.KeyServer
+		case "--no-validate":
+			options.DisableGPGValidation = true
+			continue
+		case "--force-cache":
+			options.ForceCache = true
+			continue
+		}
+		if value == nil || i+1 == len(params) {
+			options.ExtraArgs = append(options.ExtraArgs, params[i])
+			continue
+		}
+		i++
+		*value = params[i]
+	}
+	return options
+}
+
+// interruptible runs a blocking liblxc call, which can't be cancelled
+// itself. When ctx is done first, interrupt is called to make the call
+// return early, and the error of ctx is returned once it did. The container
+// handle of the call is only released by the caller after that.
+func interruptible(ctx context.Context, call func() error, interrupt func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		interrupt()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// destroyInterrupted destroys what a cancelled create or clone left of a
+// container.
+func (d *LiblxcDriver) destroyInterrupted(c *lxc.Container, name string) {
+	if !c.Defined() {
+		return
+	}
+	log.Printf("Destroying container %s, the build was cancelled", name)
+	if err := c.Destroy(); err != nil {
+		log.Printf("Error destroying container %s: %s", name, err)
+	}
+}
+
+// setenv sets environment variables in the form KEY=VALUE and returns a
+// function restoring the previous environment.
+func setenv(vars []string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return restore, fmt.Errorf("Environment variable must be in the form KEY=VALUE: %s", v)
+		}
+
+		key := parts[0]
+		if old, ok := os.LookupEnv(key); ok {
+			restores = append(restores, func() { os.Setenv(key, old) })
+		} else {
+			restores = append(restores, func() { os.Unsetenv(key) })
+		}
+		if err := os.Setenv(key, parts[1]); err != nil {
+			return restore, err
+		}
+	}
+	return restore, nil
+}
+
+// attachIO hands the streams of an AttachCmd to an attached process as file
+// descriptors, copying through pipes where they aren't files.
+type attachIO struct {
+	child   []*os.File
+	parent  []*os.File
+	copying sync.WaitGroup
+}
+
+func (a *attachIO) Reader(r io.Reader) (uintptr, error) {
+	if r == nil {
+		return a.devNull()
+	}
+	if f, ok := r.(*os.File); ok {
+		return f.Fd(), nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	a.child = append(a.child, pr)
+	// Closed by Close when the process exited without reading all of r, the
+	// copy fails then instead of blocking forever
+	a.parent = append(a.parent, pw)
+
+	go func() {
+		io.Copy(pw, r)
+		pw.Close()
+	}()
+	return pr.Fd(), nil
+}
+
+func (a *attachIO) Writer(w io.Writer) (uintptr, error) {
+	if w == nil {
+		return a.devNull()
+	}
+	if f, ok := w.(*os.File); ok {
+		return f.Fd(), nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	a.child = append(a.child, pw)
+	a.parent = append(a.parent, pr)
+
+	a.copying.Add(1)
+	go func() {
+		defer a.copying.Done()
+		io.Copy(w, pr)
+	}()
+	return pw.Fd(), nil
+}
+
+func (a *attachIO) devNull() (uintptr, error) {
+	f, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	a.child = append(a.child, f)
+	return f.Fd(), nil
+}
+
+// CloseChild closes the descriptors handed to the attached process.
+func (a *attachIO) CloseChild() {
+	for _, f := range a.child {
+		f.Close()
+	}
+	a.child = nil
+}
+
+// Wait waits until all output of the attached process is copied.
+func (a *attachIO) Wait() {
+	a.copying.Wait()
+}
+
+func (a *attachIO) Close() {
+	a.CloseChild()
+	for _, f := range a.parent {
+		f.Close()
+	}
+	a.parent = nil
+}
@@ -0,0 +1,12 @@
+//go:build !liblxc
+// +build !liblxc
+
+package lxc
+
+import "errors"
+
+const liblxcSupported = false
+
+func newLiblxcDriver(lxcPath string, wrapper CommandWrapper) (Driver, error) {
+	return nil, errors.New("The liblxc driver is not available, the plugin was built without the liblxc build tag")
+}
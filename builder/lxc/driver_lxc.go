@@ -0,0 +1,232 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LxcDriver is a Driver that runs the lxc-* command line tools with sudo.
+type LxcDriver struct {
+	// CmdWrapper wraps every command line before it is run with /bin/sh.
+	CmdWrapper CommandWrapper
+
+	// LxcPath is passed as -P to every lxc command when it is set.
+	LxcPath string
+}
+
+func (d *LxcDriver) Create(ctx context.Context, name string, opts CreateOptions) error {
+	args := append([]string{}, opts.Template.EnvVars...)
+	args = append(args, d.lxc("lxc-create", "-n", name, "-t", opts.Template.Name)...)
+
+	store := opts.BackingStore
+	if store.Type != "" {
+		args = append(args, "-B", store.Type)
+	}
+	for _, option := range [][]string{
+		{"--fstype", store.FsType},
+		{"--fssize", store.FsSize},
+		{"--vgname", store.VgName},
+		{"--lvname", store.LvName},
+		{"--thinpool", store.ThinPool},
+		{"--zfsroot", store.ZfsRoot},
+		{"--rbdname", store.RbdName},
+		{"--rbdpool", store.RbdPool},
+		{"--dir", store.Dir},
+	} {
+		if option[1] != "" {
+			args = append(args, option...)
+		}
+	}
+
+	args = append(args, "--")
+	args = append(args, opts.Template.Parameters...)
+	return sudo(ctx, d, args...)
+}
+
+func (d *LxcDriver) Clone(ctx context.Context, source string, name string, opts CloneOptions) error {
+	args := d.lxc("lxc-copy", "-n", source, "-N", name)
+	if opts.Snapshot {
+		args = append(args, "-s")
+	}
+	if opts.BackingStore.Type != "" {
+		args = append(args, "-B", opts.BackingStore.Type)
+	}
+	if opts.BackingStore.FsSize != "" {
+		args = append(args, "-L", opts.BackingStore.FsSize)
+	}
+	return sudo(ctx, d, args...)
+}
+
+func (d *LxcDriver) Start(ctx context.Context, name string, opts StartOptions) error {
+	args := d.lxc("lxc-start", "-d", "-n", name)
+	if opts.LogFile != "" {
+		args = append(args, "--logfile", opts.LogFile)
+	}
+	if opts.LogPriority != "" {
+		args = append(args, "--logpriority", opts.LogPriority)
+	}
+	if opts.ConsoleLog != "" {
+		args = append(args, "--console-log", opts.ConsoleLog)
+	}
+	return sudo(ctx, d, args...)
+}
+
+func (d *LxcDriver) Stop(ctx context.Context, name string) error {
+	return sudo(ctx, d, d.lxc("lxc-stop", "--name", name)...)
+}
+
+func (d *LxcDriver) Destroy(ctx context.Context, name string) error {
+	return sudo(ctx, d, d.lxc("lxc-destroy", "-f", "-n", name)...)
+}
+
+func (d *LxcDriver) Attach(ctx context.Context, name string, cmd *AttachCmd) (int, error) {
+	args := d.lxc("lxc-attach", "--name", name)
+	if cmd.Uid != nil {
+		args = append(args, "--uid", strconv.Itoa(*cmd.Uid))
+	}
+	if cmd.Gid != nil {
+		args = append(args, "--gid", strconv.Itoa(*cmd.Gid))
+	}
+	if cmd.ClearEnv {
+		args = append(args, "--clear-env")
+	}
+	for _, env := range cmd.Env {
+		args = append(args, "--set-var", env)
+	}
+	args = append(args, "--")
+	args = append(args, cmd.Args...)
+
+	localCmd, err := d.command(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	localCmd.Stdin = cmd.Stdin
+	localCmd.Stdout = cmd.Stdout
+	localCmd.Stderr = cmd.Stderr
+
+	log.Printf("Executing lxc-attach: %s %#v", localCmd.Path, localCmd.Args)
+	err = localCmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitStatus := 1
+
+		// There is no process-independent way to get the REAL
+		// exit status so we just try to go deeper.
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitStatus = status.ExitStatus()
+		}
+		return exitStatus, nil
+	}
+
+	return 0, err
+}
+
+func (d *LxcDriver) Info(ctx context.Context, name string) (*ContainerInfo, error) {
+	var stdout bytes.Buffer
+	err := d.SudoCommand(ctx, &HostCmd{
+		Args:   d.lxc("lxc-info", "--name", name),
+		Stdout: &stdout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ContainerInfo{Name: name}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		// State:          RUNNING
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "State":
+			info.State = value
+		case "PID":
+			info.Pid, _ = strconv.Atoi(value)
+		case "IP":
+			info.IPs = append(info.IPs, value)
+		}
+	}
+
+	if info.State == "" {
+		return nil, fmt.Errorf("Could not read state of container %s: %s", name, strings.TrimSpace(stdout.String()))
+	}
+	return info, nil
+}
+
+func (d *LxcDriver) Version(ctx context.Context) (string, error) {
+	var stdout bytes.Buffer
+	err := d.SudoCommand(ctx, &HostCmd{
+		Args:   []string{"lxc-info", "--version"},
+		Stdout: &stdout,
+	})
+	return strings.TrimSpace(stdout.String()), err
+}
+
+func (d *LxcDriver) SudoCommand(ctx context.Context, cmd *HostCmd) error {
+	localCmd, err := d.command(ctx, cmd.Args...)
+	if err != nil {
+		return err
+	}
+
+	// Output is kept for the log and error messages unless the caller wants
+	// to have it.
+	var stdout, stderr bytes.Buffer
+	localCmd.Stdin = cmd.Stdin
+	localCmd.Stdout = &stdout
+	if cmd.Stdout != nil {
+		localCmd.Stdout = cmd.Stdout
+	}
+	localCmd.Stderr = &stderr
+	if cmd.Stderr != nil {
+		localCmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	}
+
+	log.Printf("Executing sudo command: %#v", cmd.Args)
+	err = localCmd.Run()
+
+	stdoutString := strings.TrimSpace(stdout.String())
+	stderrString := strings.TrimSpace(stderr.String())
+
+	if _, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("Sudo command (%s) failed with error: %s", cmd.Args, stderrString)
+	}
+
+	if cmd.Stdout == nil {
+		log.Printf("stdout: %s", stdoutString)
+	}
+	log.Printf("stderr: %s", stderrString)
+
+	return err
+}
+
+// lxc returns the arguments of an lxc command, with the lxc path if one is
+// set.
+func (d *LxcDriver) lxc(command string, args ...string) []string {
+	if d.LxcPath == "" {
+		return append([]string{command}, args...)
+	}
+	return append([]string{command, "-P", d.LxcPath}, args...)
+}
+
+// command returns the command line for running args with sudo, passed
+// through the command wrapper.
+func (d *LxcDriver) command(ctx context.Context, args ...string) (*Cmd, error) {
+	command := ShellJoin(append([]string{"sudo"}, args...)...)
+	if d.CmdWrapper != nil {
+		var err error
+		if command, err = d.CmdWrapper(command); err != nil {
+			return nil, err
+		}
+	}
+
+	return ShellCommandContext(ctx, command), nil
+}
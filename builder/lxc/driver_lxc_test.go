@@ -0,0 +1,69 @@
+package lxc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testCommands returns a command wrapper that records the command lines and
+// runs true instead.
+func testCommands(commands *[]string) CommandWrapper {
+	return func(command string) (string, error) {
+		*commands = append(*commands, command)
+		return "true", nil
+	}
+}
+
+func TestLxcDriver_lxcPath(t *testing.T) {
+	cases := []struct {
+		lxcPath string
+		want    []string
+	}{
+		{"", []string{
+			"sudo lxc-create -n packer -t debian -- -r stretch",
+			"sudo lxc-copy -n base -N packer",
+			"sudo lxc-start -d -n packer",
+			"sudo lxc-attach --name packer -- /bin/sh -c true",
+			"sudo lxc-stop --name packer",
+			"sudo lxc-destroy -f -n packer",
+		}},
+		{"/srv/lxc", []string{
+			"sudo lxc-create -P /srv/lxc -n packer -t debian -- -r stretch",
+			"sudo lxc-copy -P /srv/lxc -n base -N packer",
+			"sudo lxc-start -P /srv/lxc -d -n packer",
+			"sudo lxc-attach -P /srv/lxc --name packer -- /bin/sh -c true",
+			"sudo lxc-stop -P /srv/lxc --name packer",
+			"sudo lxc-destroy -P /srv/lxc -f -n packer",
+		}},
+	}
+	for _, c := range cases {
+		var commands []string
+		driver := &LxcDriver{CmdWrapper: testCommands(&commands), LxcPath: c.lxcPath}
+		ctx := context.Background()
+
+		template := LxcTemplateConfig{Name: "debian", Parameters: []string{"-r", "stretch"}}
+		if err := driver.Create(ctx, "packer", CreateOptions{Template: template}); err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.Clone(ctx, "base", "packer", CloneOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.Start(ctx, "packer", StartOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := driver.Attach(ctx, "packer", &AttachCmd{Args: []string{"/bin/sh", "-c", "true"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.Stop(ctx, "packer"); err != nil {
+			t.Fatal(err)
+		}
+		if err := driver.Destroy(ctx, "packer"); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(commands, c.want) {
+			t.Errorf("lxc_path %q: commands\n%q\nwant\n%q", c.lxcPath, commands, c.want)
+		}
+	}
+}
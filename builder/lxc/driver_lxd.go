@@ -0,0 +1,612 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lxdSockets are the places LXD and Incus put their unix socket, tried in
+// order when lxd_socket isn't set.
+var lxdSockets = []string{
+	"/var/snap/lxd/common/lxd/unix.socket",
+	"/var/lib/lxd/unix.socket",
+	"/var/lib/incus/unix.socket",
+}
+
+// lxdRemotes are the image servers that can be used as prefix of an image,
+// like images:debian/9.
+var lxdRemotes = map[string]string{
+	"images":       "https://images.linuxcontainers.org",
+	"ubuntu":       "https://cloud-images.ubuntu.com/releases",
+	"ubuntu-daily": "https://cloud-images.ubuntu.com/daily",
+}
+
+var lxdFingerprint = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// lxdStateTimeout is how long LXD waits for a container to start or to stop
+// cleanly.
+const lxdStateTimeout = 30 * time.Second
+
+// LxdDriver is a Driver that manages containers through the REST API of LXD
+// or Incus on the local unix socket. Other commands on the host, like tar,
+// still run with sudo through the embedded LxcDriver.
+type LxdDriver struct {
+	LxcDriver
+
+	Socket string
+	client *http.Client
+}
+
+type lxdResponse struct {
+	Type       string          `json:"type"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Operation  string          `json:"operation"`
+	ErrorCode  int             `json:"error_code"`
+	Error      string          `json:"error"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+type lxdOperation struct {
+	Id         string                     `json:"id"`
+	StatusCode int                        `json:"status_code"`
+	Err        string                     `json:"err"`
+	Metadata   map[string]json.RawMessage `json:"metadata"`
+}
+
+type lxdState struct {
+	Status  string `json:"status"`
+	Pid     int    `json:"pid"`
+	Network map[string]struct {
+		Addresses []struct {
+			Family  string `json:"family"`
+			Address string `json:"address"`
+			Scope   string `json:"scope"`
+		} `json:"addresses"`
+	} `json:"network"`
+}
+
+func newLxdDriver(socket string, wrapper CommandWrapper) (Driver, error) {
+	if socket == "" {
+		socket = findLxdSocket()
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("Could not find the LXD socket, set lxd_socket")
+	}
+
+	d := &LxdDriver{
+		LxcDriver: LxcDriver{CmdWrapper: wrapper},
+		Socket:    socket,
+	}
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", d.Socket)
+			},
+		},
+	}
+	return d, nil
+}
+
+func findLxdSocket() string {
+	sockets := lxdSockets
+	for _, env := range []string{"INCUS_DIR", "LXD_DIR"} {
+		if dir := os.Getenv(env); dir != "" {
+			sockets = append([]string{dir + "/unix.socket"}, sockets...)
+		}
+	}
+
+	for _, socket := range sockets {
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+	return ""
+}
+
+func (d *LxdDriver) Create(ctx context.Context, name string, opts CreateOptions) error {
+	source, err := lxdImageSource(opts.Template.Name)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Creating container %s from image %s", name, opts.Template.Name)
+	_, err = d.wait(ctx, "POST", "/1.0/instances", map[string]interface{}{
+		"name":   name,
+		"type":   "container",
+		"source": source,
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating container %s: %s", name, err)
+	}
+	return nil
+}
+
+func (d *LxdDriver) Clone(ctx context.Context, source string, name string, opts CloneOptions) error {
+	// LXD picks the fastest way to copy for its storage pool itself
+	log.Printf("Copying container %s to %s", source, name)
+	_, err := d.wait(ctx, "POST", "/1.0/instances", map[string]interface{}{
+		"name": name,
+		"type": "container",
+		"source": map[string]interface{}{
+			"type":          "copy",
+			"source":        source,
+			"instance_only": true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error copying container %s: %s", source, err)
+	}
+	return nil
+}
+
+func (d *LxdDriver) Start(ctx context.Context, name string, opts StartOptions) error {
+	// LXD keeps the logs of its containers itself
+	log.Printf("Starting container %s", name)
+	return d.setState(ctx, name, "start", false)
+}
+
+func (d *LxdDriver) Stop(ctx context.Context, name string) error {
+	log.Printf("Stopping container %s", name)
+	return d.setState(ctx, name, "stop", false)
+}
+
+func (d *LxdDriver) Destroy(ctx context.Context, name string) error {
+	info, err := d.Info(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Destroying container %s", name)
+	if info.State != "STOPPED" {
+		if err := d.setState(ctx, name, "stop", true); err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.wait(ctx, "DELETE", d.instancePath(name, ""), nil); err != nil {
+		return fmt.Errorf("Error destroying container %s: %s", name, err)
+	}
+	return nil
+}
+
+func (d *LxdDriver) Attach(ctx context.Context, name string, cmd *AttachCmd) (int, error) {
+	if cmd.ClearEnv {
+		// LXD always sets up PATH, HOME and the like itself
+		return 0, fmt.Errorf("Clearing the environment is not supported by LXD")
+	}
+
+	env := make(map[string]string)
+	for _, v := range cmd.Env {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	request := map[string]interface{}{
+		"command":            cmd.Args,
+		"environment":        env,
+		"wait-for-websocket": true,
+		"interactive":        false,
+	}
+	if cmd.Uid != nil {
+		request["user"] = *cmd.Uid
+	}
+	if cmd.Gid != nil {
+		request["group"] = *cmd.Gid
+	}
+
+	log.Printf("Executing in container %s: %#v", name, cmd.Args)
+	resp, err := d.request(ctx, "POST", d.instancePath(name, "/exec"), request)
+	if err != nil {
+		return 0, fmt.Errorf("Error executing in container %s: %s", name, err)
+	}
+
+	var op lxdOperation
+	if err := json.Unmarshal(resp.Metadata, &op); err != nil {
+		return 0, err
+	}
+	var fds map[string]string
+	if err := json.Unmarshal(op.Metadata["fds"], &fds); err != nil {
+		return 0, fmt.Errorf("Error reading exec streams: %s", err)
+	}
+
+	// LXD runs the command once all of its streams are connected
+	conns := make(map[string]*wsConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, fd := range []string{"control", "0", "1", "2"} {
+		path := fmt.Sprintf("/1.0/operations/%s/websocket?secret=%s", op.Id, url.QueryEscape(fds[fd]))
+		conn, err := dialWebsocket(ctx, d.Socket, path)
+		if err != nil {
+			return 0, fmt.Errorf("Error connecting to exec stream %s: %s", fd, err)
+		}
+		conns[fd] = conn
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conns["control"].WriteMessage(wsText, []byte(`{"command":"signal","signal":9}`))
+		case <-done:
+		}
+	}()
+
+	go conns["0"].sendStream(cmd.Stdin)
+
+	var streams sync.WaitGroup
+	for fd, w := range map[string]io.Writer{"1": cmd.Stdout, "2": cmd.Stderr} {
+		streams.Add(1)
+		go func(conn *wsConn, w io.Writer) {
+			defer streams.Done()
+			if err := conn.recvStream(w); err != nil {
+				log.Printf("Error reading exec stream: %s", err)
+			}
+		}(conns[fd], w)
+	}
+	streams.Wait()
+
+	result, err := d.waitOperation(ctx, op.Id)
+	if err != nil {
+		return 0, fmt.Errorf("Error executing in container %s: %s", name, err)
+	}
+
+	var exitStatus int
+	if err := json.Unmarshal(result.Metadata["return"], &exitStatus); err != nil {
+		return 0, fmt.Errorf("Error reading exit status: %s", err)
+	}
+	return exitStatus, nil
+}
+
+func (d *LxdDriver) Info(ctx context.Context, name string) (*ContainerInfo, error) {
+	resp, err := d.request(ctx, "GET", d.instancePath(name, "/state"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var state lxdState
+	if err := json.Unmarshal(resp.Metadata, &state); err != nil {
+		return nil, err
+	}
+
+	info := &ContainerInfo{
+		Name:  name,
+		State: strings.ToUpper(state.Status),
+		Pid:   state.Pid,
+	}
+	for iface, network := range state.Network {
+		if iface == "lo" {
+			continue
+		}
+		for _, addr := range network.Addresses {
+			info.IPs = append(info.IPs, addr.Address)
+		}
+	}
+	return info, nil
+}
+
+func (d *LxdDriver) Version(ctx context.Context) (string, error) {
+	resp, err := d.request(ctx, "GET", "/1.0", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var server struct {
+		Environment struct {
+			Server        string `json:"server"`
+			ServerVersion string `json:"server_version"`
+		} `json:"environment"`
+	}
+	if err := json.Unmarshal(resp.Metadata, &server); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(server.Environment.Server + " " + server.Environment.ServerVersion), nil
+}
+
+func (d *LxdDriver) PushFile(ctx context.Context, name string, file *ContainerFile) error {
+	fileType := "file"
+	switch {
+	case file.Mode.IsDir():
+		fileType = "directory"
+	case file.Mode&os.ModeSymlink != 0:
+		fileType = "symlink"
+	}
+
+	body := file.Content
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	req, err := http.NewRequest("POST", d.filePath(name, file.Path), body)
+	if err != nil {
+		return err
+	}
+
+	// Incus renamed the headers of LXD, both understand their own
+	headers := map[string]string{
+		"uid":   strconv.Itoa(file.Uid),
+		"gid":   strconv.Itoa(file.Gid),
+		"mode":  octalMode(file.Mode),
+		"type":  fileType,
+		"write": "overwrite",
+	}
+	for key, value := range headers {
+		req.Header.Set("X-LXD-"+key, value)
+		req.Header.Set("X-Incus-"+key, value)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	log.Printf("Pushing %s %s to container %s", fileType, file.Path, name)
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := lxdParseResponse(resp); err != nil {
+		return fmt.Errorf("Error pushing %s to container %s: %s", file.Path, name, err)
+	}
+	return nil
+}
+
+func (d *LxdDriver) PullFile(ctx context.Context, name string, path string, w io.Writer) error {
+	req, err := http.NewRequest("GET", d.filePath(name, path), nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Pulling %s from container %s", path, name)
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, err := lxdParseResponse(resp)
+		return fmt.Errorf("Error pulling %s from container %s: %s", path, name, err)
+	}
+	for _, header := range []string{"X-LXD-type", "X-Incus-type"} {
+		if resp.Header.Get(header) == "directory" {
+			return fmt.Errorf("Error pulling %s from container %s: is a directory", path, name)
+		}
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (d *LxdDriver) Publish(ctx context.Context, name string, opts PublishOptions, w io.Writer) (string, error) {
+	var aliasExists bool
+	if opts.Alias != "" {
+		var err error
+		if aliasExists, err = d.imageAliasExists(ctx, opts.Alias); err != nil {
+			return "", fmt.Errorf("Error reading image aliases: %s", err)
+		}
+		if aliasExists && !opts.Replace {
+			return "", fmt.Errorf("Image alias %s already exists, use -force to move it to the new image", opts.Alias)
+		}
+	}
+
+	log.Printf("Publishing container %s as image", name)
+	op, err := d.wait(ctx, "POST", "/1.0/images", map[string]interface{}{
+		"source": map[string]string{
+			"type": "instance",
+			"name": name,
+		},
+		"properties": map[string]string{
+			"description": fmt.Sprintf("Packer build of %s", name),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error publishing container %s: %s", name, err)
+	}
+
+	var fingerprint string
+	if err := json.Unmarshal(op.Metadata["fingerprint"], &fingerprint); err != nil {
+		return "", fmt.Errorf("Error reading image fingerprint: %s", err)
+	}
+
+	// The alias is set once the image exists, an alias that is moved keeps
+	// pointing to the old image until then
+	if opts.Alias != "" {
+		log.Printf("Setting alias %s of image %s", opts.Alias, fingerprint)
+		if aliasExists {
+			_, err = d.request(ctx, "PUT", lxdAliasPath(opts.Alias), map[string]string{"target": fingerprint})
+		} else {
+			_, err = d.request(ctx, "POST", "/1.0/images/aliases", map[string]string{"name": opts.Alias, "target": fingerprint})
+		}
+		if err != nil {
+			return fingerprint, fmt.Errorf("Error setting alias %s of image %s: %s", opts.Alias, fingerprint, err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://unix.socket/1.0/images/"+fingerprint+"/export", nil)
+	if err != nil {
+		return fingerprint, err
+	}
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fingerprint, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, err := lxdParseResponse(resp)
+		return fingerprint, fmt.Errorf("Error exporting image %s: %s", fingerprint, err)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/") {
+		return fingerprint, fmt.Errorf("Error exporting image %s: split images are not supported", fingerprint)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return fingerprint, err
+}
+
+func (d *LxdDriver) DeleteImage(ctx context.Context, fingerprint string) error {
+	log.Printf("Deleting image %s", fingerprint)
+	if _, err := d.wait(ctx, "DELETE", "/1.0/images/"+fingerprint, nil); err != nil {
+		return fmt.Errorf("Error deleting image %s: %s", fingerprint, err)
+	}
+	return nil
+}
+
+// imageAliasExists returns if an image alias is taken.
+func (d *LxdDriver) imageAliasExists(ctx context.Context, alias string) (bool, error) {
+	resp, err := d.request(ctx, "GET", "/1.0/images/aliases", nil)
+	if err != nil {
+		return false, err
+	}
+	var aliases []string
+	if err := json.Unmarshal(resp.Metadata, &aliases); err != nil {
+		return false, err
+	}
+	for _, path := range aliases {
+		if path == lxdAliasPath(alias) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func lxdAliasPath(alias string) string {
+	return "/1.0/images/aliases/" + url.PathEscape(alias)
+}
+
+func (d *LxdDriver) instancePath(name string, suffix string) string {
+	return "/1.0/instances/" + name + suffix
+}
+
+func (d *LxdDriver) filePath(name string, path string) string {
+	return "http://unix.socket" + d.instancePath(name, "/files") + "?path=" + url.QueryEscape(path)
+}
+
+func (d *LxdDriver) setState(ctx context.Context, name string, action string, force bool) error {
+	_, err := d.wait(ctx, "PUT", d.instancePath(name, "/state"), map[string]interface{}{
+		"action":  action,
+		"timeout": int(lxdStateTimeout / time.Second),
+		"force":   force,
+	})
+	if err != nil {
+		return fmt.Errorf("Error running %s on container %s: %s", action, name, err)
+	}
+	return nil
+}
+
+// request sends a request to the API and returns its response, which may be
+// a background operation.
+func (d *LxdDriver) request(ctx context.Context, method string, path string, body interface{}) (*lxdResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://unix.socket"+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return lxdParseResponse(resp)
+}
+
+// wait sends a request to the API and waits for its background operation to
+// finish.
+func (d *LxdDriver) wait(ctx context.Context, method string, path string, body interface{}) (*lxdOperation, error) {
+	resp, err := d.request(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != "async" {
+		return &lxdOperation{StatusCode: resp.StatusCode}, nil
+	}
+
+	var op lxdOperation
+	if err := json.Unmarshal(resp.Metadata, &op); err != nil {
+		return nil, err
+	}
+	return d.waitOperation(ctx, op.Id)
+}
+
+func (d *LxdDriver) waitOperation(ctx context.Context, id string) (*lxdOperation, error) {
+	resp, err := d.request(ctx, "GET", "/1.0/operations/"+id+"/wait", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var op lxdOperation
+	if err := json.Unmarshal(resp.Metadata, &op); err != nil {
+		return nil, err
+	}
+	if op.Err != "" {
+		return &op, fmt.Errorf("%s", op.Err)
+	}
+	return &op, nil
+}
+
+func lxdParseResponse(resp *http.Response) (*lxdResponse, error) {
+	var result lxdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Invalid response from LXD (%s): %s", resp.Status, err)
+	}
+	if result.Type == "error" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	return &result, nil
+}
+
+// lxdImageSource returns the source of a container for an image given as
+// alias or fingerprint, optionally prefixed with a known remote.
+func lxdImageSource(image string) (map[string]string, error) {
+	source := map[string]string{"type": "image"}
+
+	parts := strings.SplitN(image, ":", 2)
+	if len(parts) == 2 {
+		server, ok := lxdRemotes[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown image remote: %s", parts[0])
+		}
+		source["server"] = server
+		source["protocol"] = "simplestreams"
+		source["mode"] = "pull"
+		image = parts[1]
+	}
+
+	if lxdFingerprint.MatchString(image) {
+		source["fingerprint"] = image
+	} else {
+		source["alias"] = image
+	}
+	return source, nil
+}
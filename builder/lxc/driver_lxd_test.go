@@ -0,0 +1,379 @@
+package lxc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeLxd serves the parts of the LXD API the driver uses on a unix socket.
+type fakeLxd struct {
+	socket string
+	mux    *http.ServeMux
+	server *http.Server
+	dir    string
+}
+
+func newFakeLxd(t *testing.T) *fakeLxd {
+	dir, err := ioutil.TempDir("", "lxd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "unix.socket")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	f := &fakeLxd{socket: socket, mux: http.NewServeMux(), dir: dir}
+	f.server = &http.Server{Handler: f.mux}
+	go f.server.Serve(listener)
+	return f
+}
+
+func (f *fakeLxd) Close() {
+	f.server.Close()
+	os.RemoveAll(f.dir)
+}
+
+func (f *fakeLxd) driver(t *testing.T) *LxdDriver {
+	driver, err := newLxdDriver(f.socket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver.(*LxdDriver)
+}
+
+func writeLxdResponse(w http.ResponseWriter, responseType string, metadata interface{}) {
+	data, _ := json.Marshal(metadata)
+	json.NewEncoder(w).Encode(&lxdResponse{
+		Type:       responseType,
+		Status:     "Success",
+		StatusCode: 200,
+		Metadata:   data,
+	})
+}
+
+// acceptWebsocket answers the websocket handshake and hands over the
+// connection. The server side speaks through a wsConn too, its masked frames
+// are fine for the client.
+func acceptWebsocket(t *testing.T, w http.ResponseWriter, r *http.Request) *wsConn {
+	hash := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	rw.Flush()
+	return &wsConn{conn: conn, r: rw.Reader}
+}
+
+func TestLxdDriver_Info(t *testing.T) {
+	lxd := newFakeLxd(t)
+	defer lxd.Close()
+	lxd.mux.HandleFunc("/1.0/instances/packer/state", func(w http.ResponseWriter, r *http.Request) {
+		writeLxdResponse(w, "sync", map[string]interface{}{
+			"status": "Running",
+			"pid":    42,
+			"network": map[string]interface{}{
+				"lo":   map[string]interface{}{"addresses": []map[string]string{{"address": "127.0.0.1"}}},
+				"eth0": map[string]interface{}{"addresses": []map[string]string{{"address": "10.0.3.2"}}},
+			},
+		})
+	})
+	lxd.mux.HandleFunc("/1.0/instances/missing/state", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&lxdResponse{Type: "error", ErrorCode: 404, Error: "Instance not found"})
+	})
+
+	driver := lxd.driver(t)
+	info, err := driver.Info(context.Background(), "packer")
+	if err != nil {
+		t.Fatalf("Info: %s", err)
+	}
+	if info.State != "RUNNING" || info.Pid != 42 || len(info.IPs) != 1 || info.IPs[0] != "10.0.3.2" {
+		t.Errorf("unexpected info: %#v", info)
+	}
+
+	if _, err := driver.Info(context.Background(), "missing"); err == nil || !strings.Contains(err.Error(), "Instance not found") {
+		t.Errorf("expected the error of LXD, got %v", err)
+	}
+}
+
+func TestLxdDriver_Attach(t *testing.T) {
+	lxd := newFakeLxd(t)
+	defer lxd.Close()
+
+	var request map[string]interface{}
+	lxd.mux.HandleFunc("/1.0/instances/packer/exec", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		writeLxdResponse(w, "async", map[string]interface{}{
+			"id": "op",
+			"metadata": map[string]interface{}{
+				"fds": map[string]string{"control": "c", "0": "in", "1": "out", "2": "err"},
+			},
+		})
+	})
+
+	// The command echoes its stdin to stdout, which also makes the frames
+	// go both ways
+	stdin := make(chan []byte, 1)
+	lxd.mux.HandleFunc("/1.0/operations/op/websocket", func(w http.ResponseWriter, r *http.Request) {
+		conn := acceptWebsocket(t, w, r)
+		if conn == nil {
+			return
+		}
+		defer conn.conn.Close()
+
+		switch r.URL.Query().Get("secret") {
+		case "c":
+			conn.ReadMessage()
+		case "in":
+			var buf bytes.Buffer
+			if err := conn.recvStream(&buf); err != nil {
+				t.Errorf("reading stdin: %s", err)
+			}
+			stdin <- buf.Bytes()
+		case "out":
+			data := <-stdin
+			conn.WriteMessage(wsBinary, data)
+			conn.WriteMessage(wsClose, nil)
+		case "err":
+			conn.WriteMessage(wsBinary, []byte("warning\n"))
+			conn.WriteMessage(wsClose, nil)
+		}
+	})
+	lxd.mux.HandleFunc("/1.0/operations/op/wait", func(w http.ResponseWriter, r *http.Request) {
+		writeLxdResponse(w, "sync", map[string]interface{}{
+			"id":       "op",
+			"metadata": map[string]interface{}{"return": 3},
+		})
+	})
+
+	// More than fits into a frame with a 16 bit length
+	input := bytes.Repeat([]byte("packer "), 20000)
+	var stdout, stderr bytes.Buffer
+	uid := 1000
+	exitStatus, err := lxd.driver(t).Attach(context.Background(), "packer", &AttachCmd{
+		Args:   []string{"cat"},
+		Uid:    &uid,
+		Env:    []string{"FOO=bar"},
+		Stdin:  bytes.NewReader(input),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		t.Fatalf("Attach: %s", err)
+	}
+	if exitStatus != 3 {
+		t.Errorf("exit status = %d, want 3", exitStatus)
+	}
+	if !bytes.Equal(stdout.Bytes(), input) {
+		t.Errorf("stdout has %d bytes, want %d", stdout.Len(), len(input))
+	}
+	if stderr.String() != "warning\n" {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+
+	if env, _ := request["environment"].(map[string]interface{}); env["FOO"] != "bar" {
+		t.Errorf("environment not sent: %#v", request["environment"])
+	}
+	if request["user"] != float64(1000) {
+		t.Errorf("user = %#v, want 1000", request["user"])
+	}
+}
+
+func TestLxdDriver_AttachClearEnv(t *testing.T) {
+	lxd := newFakeLxd(t)
+	defer lxd.Close()
+
+	_, err := lxd.driver(t).Attach(context.Background(), "packer", &AttachCmd{
+		Args:     []string{"true"},
+		ClearEnv: true,
+	})
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestLxdDriver_PushFile(t *testing.T) {
+	lxd := newFakeLxd(t)
+	defer lxd.Close()
+
+	var header http.Header
+	var path, content string
+	lxd.mux.HandleFunc("/1.0/instances/packer/files", func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		path = r.URL.Query().Get("path")
+		data, _ := ioutil.ReadAll(r.Body)
+		content = string(data)
+		writeLxdResponse(w, "sync", nil)
+	})
+
+	err := lxd.driver(t).PushFile(context.Background(), "packer", &ContainerFile{
+		Path:    "/etc/motd",
+		Mode:    0640,
+		Content: strings.NewReader("hello"),
+	})
+	if err != nil {
+		t.Fatalf("PushFile: %s", err)
+	}
+	if path != "/etc/motd" || content != "hello" {
+		t.Errorf("pushed %q to %s", content, path)
+	}
+	for _, prefix := range []string{"X-LXD-", "X-Incus-"} {
+		if header.Get(prefix+"uid") != "0" || header.Get(prefix+"mode") != "0640" || header.Get(prefix+"type") != "file" {
+			t.Errorf("unexpected %s headers: %v", prefix, header)
+		}
+	}
+}
+
+func TestLxdDriver_Publish(t *testing.T) {
+	cases := []struct {
+		alias   string
+		replace bool
+		method  string
+		err     string
+	}{
+		{"", false, "", ""},
+		{"base", false, "POST", ""},
+		{"taken", false, "", "Image alias taken already exists"},
+		{"taken", true, "PUT", ""},
+	}
+	for _, c := range cases {
+		lxd := newFakeLxd(t)
+		defer lxd.Close()
+
+		var published bool
+		var aliasMethod string
+		var aliasRequest map[string]string
+		lxd.mux.HandleFunc("/1.0/images", func(w http.ResponseWriter, r *http.Request) {
+			published = true
+			writeLxdResponse(w, "async", map[string]interface{}{"id": "op"})
+		})
+		lxd.mux.HandleFunc("/1.0/operations/op/wait", func(w http.ResponseWriter, r *http.Request) {
+			writeLxdResponse(w, "sync", map[string]interface{}{
+				"id":       "op",
+				"metadata": map[string]interface{}{"fingerprint": "0123456789abcdef"},
+			})
+		})
+		lxd.mux.HandleFunc("/1.0/images/0123456789abcdef/export", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("image"))
+		})
+		lxd.mux.HandleFunc("/1.0/images/aliases", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				writeLxdResponse(w, "sync", []string{"/1.0/images/aliases/taken"})
+				return
+			}
+			aliasMethod = r.Method
+			json.NewDecoder(r.Body).Decode(&aliasRequest)
+			writeLxdResponse(w, "sync", nil)
+		})
+		lxd.mux.HandleFunc("/1.0/images/aliases/taken", func(w http.ResponseWriter, r *http.Request) {
+			aliasMethod = r.Method
+			json.NewDecoder(r.Body).Decode(&aliasRequest)
+			writeLxdResponse(w, "sync", nil)
+		})
+
+		var image bytes.Buffer
+		opts := PublishOptions{Alias: c.alias, Replace: c.replace}
+		fingerprint, err := lxd.driver(t).Publish(context.Background(), "packer", opts, &image)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("alias %q: expected %q, got %v", c.alias, c.err, err)
+			}
+			if published {
+				t.Errorf("alias %q: published although the alias is taken", c.alias)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("alias %q: Publish: %s", c.alias, err)
+		}
+		if fingerprint != "0123456789abcdef" || image.String() != "image" {
+			t.Errorf("alias %q: published %s with %q", c.alias, fingerprint, image.String())
+		}
+		if aliasMethod != c.method {
+			t.Errorf("alias %q: alias set with %q, want %q", c.alias, aliasMethod, c.method)
+		}
+		if c.alias != "" && aliasRequest["target"] != fingerprint {
+			t.Errorf("alias %q: alias points to %q", c.alias, aliasRequest["target"])
+		}
+	}
+}
+
+func TestLxdDriver_DeleteImage(t *testing.T) {
+	lxd := newFakeLxd(t)
+	defer lxd.Close()
+
+	var method string
+	lxd.mux.HandleFunc("/1.0/images/0123456789abcdef", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		writeLxdResponse(w, "sync", nil)
+	})
+
+	if err := lxd.driver(t).DeleteImage(context.Background(), "0123456789abcdef"); err != nil {
+		t.Fatalf("DeleteImage: %s", err)
+	}
+	if method != "DELETE" {
+		t.Errorf("image requested with %s, want DELETE", method)
+	}
+}
+
+func TestWsConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &wsConn{conn: client, r: bufio.NewReader(client)}
+	s := &wsConn{conn: server, r: bufio.NewReader(server)}
+
+	cases := [][]byte{
+		{},
+		[]byte("short"),
+		bytes.Repeat([]byte{'a'}, 126),
+		bytes.Repeat([]byte{'b'}, 0x10000),
+	}
+	for _, data := range cases {
+		go c.WriteMessage(wsBinary, data)
+		opcode, message, err := s.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if opcode != wsBinary || !bytes.Equal(message, data) {
+			t.Errorf("read opcode %d with %d bytes, want %d bytes", opcode, len(message), len(data))
+		}
+	}
+
+	// Pings are answered while reading
+	pong := make(chan byte, 1)
+	go func() {
+		_, opcode, _, _ := s.readFrame()
+		pong <- opcode
+	}()
+	go func() {
+		s.WriteMessage(wsPing, []byte("ping"))
+		s.WriteMessage(wsText, []byte("after ping"))
+	}()
+	opcode, message, err := c.ReadMessage()
+	if err != nil || opcode != wsText || string(message) != "after ping" {
+		t.Errorf("ReadMessage after a ping: %d %q %v", opcode, message, err)
+	}
+	if opcode := <-pong; opcode != wsPong {
+		t.Errorf("ping answered with opcode %d", opcode)
+	}
+}
@@ -0,0 +1,192 @@
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MockDriver is a Driver that keeps its containers in memory, for testing
+// the steps without LXC.
+type MockDriver struct {
+	sync.Mutex
+
+	Containers map[string]*ContainerInfo
+
+	CreateCalled  bool
+	CreateName    string
+	CreateOptions CreateOptions
+	CreateErr     error
+
+	CloneCalled  bool
+	CloneSource  string
+	CloneName    string
+	CloneOptions CloneOptions
+	CloneErr     error
+
+	StartCalled  bool
+	StartName    string
+	StartOptions StartOptions
+	StartErr     error
+
+	StopCalled bool
+	StopName   string
+	StopErr    error
+
+	DestroyCalled bool
+	DestroyName   string
+	DestroyErr    error
+
+	AttachCommands [][]string
+	AttachFn       func(name string, cmd *AttachCmd) (int, error)
+
+	InfoErr error
+
+	VersionResult string
+	VersionErr    error
+
+	SudoCommands [][]string
+	SudoFn       func(cmd *HostCmd) error
+}
+
+func (d *MockDriver) Create(ctx context.Context, name string, opts CreateOptions) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.CreateCalled = true
+	d.CreateName = name
+	d.CreateOptions = opts
+	if d.CreateErr != nil {
+		return d.CreateErr
+	}
+
+	d.setState(name, "STOPPED")
+	return nil
+}
+
+func (d *MockDriver) Clone(ctx context.Context, source string, name string, opts CloneOptions) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.CloneCalled = true
+	d.CloneSource = source
+	d.CloneName = name
+	d.CloneOptions = opts
+	if d.CloneErr != nil {
+		return d.CloneErr
+	}
+	if _, ok := d.Containers[source]; !ok {
+		return fmt.Errorf("Container %s doesn't exist", source)
+	}
+
+	d.setState(name, "STOPPED")
+	return nil
+}
+
+func (d *MockDriver) Start(ctx context.Context, name string, opts StartOptions) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.StartCalled = true
+	d.StartName = name
+	d.StartOptions = opts
+	if d.StartErr != nil {
+		return d.StartErr
+	}
+
+	d.setState(name, "RUNNING")
+	return nil
+}
+
+func (d *MockDriver) Stop(ctx context.Context, name string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.StopCalled = true
+	d.StopName = name
+	if d.StopErr != nil {
+		return d.StopErr
+	}
+
+	if c, ok := d.Containers[name]; ok {
+		c.State = "STOPPED"
+	}
+	return nil
+}
+
+func (d *MockDriver) Destroy(ctx context.Context, name string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.DestroyCalled = true
+	d.DestroyName = name
+	if d.DestroyErr != nil {
+		return d.DestroyErr
+	}
+
+	delete(d.Containers, name)
+	return nil
+}
+
+func (d *MockDriver) Attach(ctx context.Context, name string, cmd *AttachCmd) (int, error) {
+	d.Lock()
+	d.AttachCommands = append(d.AttachCommands, cmd.Args)
+	c, ok := d.Containers[name]
+	running := ok && c.State == "RUNNING"
+	fn := d.AttachFn
+	d.Unlock()
+
+	if !running {
+		return 0, fmt.Errorf("Container %s is not running", name)
+	}
+	if fn != nil {
+		return fn(name, cmd)
+	}
+	return 0, nil
+}
+
+func (d *MockDriver) Info(ctx context.Context, name string) (*ContainerInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.InfoErr != nil {
+		return nil, d.InfoErr
+	}
+
+	c, ok := d.Containers[name]
+	if !ok {
+		return nil, fmt.Errorf("Container %s doesn't exist", name)
+	}
+
+	info := *c
+	return &info, nil
+}
+
+func (d *MockDriver) Version(ctx context.Context) (string, error) {
+	return d.VersionResult, d.VersionErr
+}
+
+func (d *MockDriver) SudoCommand(ctx context.Context, cmd *HostCmd) error {
+	d.Lock()
+	d.SudoCommands = append(d.SudoCommands, cmd.Args)
+	fn := d.SudoFn
+	d.Unlock()
+
+	if fn != nil {
+		return fn(cmd)
+	}
+	return nil
+}
+
+func (d *MockDriver) setState(name string, state string) {
+	if d.Containers == nil {
+		d.Containers = make(map[string]*ContainerInfo)
+	}
+
+	c, ok := d.Containers[name]
+	if !ok {
+		c = &ContainerInfo{Name: name}
+		d.Containers[name] = c
+	}
+	c.State = state
+}
@@ -25,8 +25,11 @@ func (c *lxcConfig) SetRootFs(path string) {
 	c.setProp("lxc.rootfs", path)
 }
 
+// setProp replaces the first line setting key, or appends one. The key has to
+// match exactly, lxc.rootfs doesn't replace lxc.rootfs.path or
+// lxc.rootfs.options.
 func (c *lxcConfig) setProp(key string, value string) {
-	pattern := regexp.MustCompile(`^\s*` + key + `=\s*.*$`)
+	pattern := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(key) + `\s*=\s*.*$`)
 	for i, line := range c.lines {
 		if pattern.MatchString(line) {
 			c.lines[i] = key + " = " + value
@@ -36,6 +39,16 @@ func (c *lxcConfig) setProp(key string, value string) {
 	c.lines = append(c.lines, key+" = "+value)
 }
 
+func (c *lxcConfig) getProp(key string) string {
+	pattern := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(key) + `\s*=\s*(.*?)\s*$`)
+	for _, line := range c.lines {
+		if match := pattern.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
 func (c *lxcConfig) Write(filename string) error {
 	output := strings.Join(c.lines, "\n")
 	err := ioutil.WriteFile(filename, []byte(output), 0644)
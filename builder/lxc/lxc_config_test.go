@@ -0,0 +1,40 @@
+package lxc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLxcConfig_setProp(t *testing.T) {
+	cases := []struct {
+		lines []string
+		key   string
+		want  []string
+	}{
+		{
+			[]string{"lxc.rootfs.path = dir:/old", "lxc.rootfs.options = idmap=container"},
+			"lxc.rootfs",
+			[]string{"lxc.rootfs.path = dir:/old", "lxc.rootfs.options = idmap=container", "lxc.rootfs = new"},
+		},
+		{
+			[]string{"  lxc.rootfs.path=dir:/old", "lxc.rootfs = /other"},
+			"lxc.rootfs.path",
+			[]string{"lxc.rootfs.path = new", "lxc.rootfs = /other"},
+		},
+		{
+			[]string{"lxcXrootfs = /old"},
+			"lxc.rootfs",
+			[]string{"lxcXrootfs = /old", "lxc.rootfs = new"},
+		},
+	}
+	for _, c := range cases {
+		config := &lxcConfig{lines: c.lines}
+		config.setProp(c.key, "new")
+		if !reflect.DeepEqual(config.lines, c.want) {
+			t.Errorf("setProp(%q): got %q, want %q", c.key, config.lines, c.want)
+		}
+		if got := config.getProp(c.key); got != "new" {
+			t.Errorf("getProp(%q) = %q, want new", c.key, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// rootfsMount is the rootfs of a stopped container made available on the
+// host. Directory backed stores are used in place, block backed stores are
+// mounted on the rootfs directory of the container until Unmount.
+type rootfsMount struct {
+	Path string
+
+	driver  Driver
+	mounted bool
+}
+
+// rootfsSpec reads the rootfs of a container from its config, like
+// lvm:/dev/lxc/name or /var/lib/lxc/name/rootfs.
+func rootfsSpec(ctx context.Context, driver Driver, lxcPath string, name string) (string, error) {
+	if d, ok := driver.(ConfigDriver); ok {
+		// LXC 2.1 renamed lxc.rootfs to lxc.rootfs.path
+		for _, key := range []string{"lxc.rootfs.path", "lxc.rootfs"} {
+			spec, err := d.ConfigItem(ctx, name, key)
+			if err != nil {
+				return "", err
+			}
+			if spec != "" {
+				return spec, nil
+			}
+		}
+		return "", fmt.Errorf("No rootfs in the config of container %s", name)
+	}
+
+	var stdout bytes.Buffer
+	err := driver.SudoCommand(ctx, &HostCmd{
+		Args:   []string{"cat", filepath.Join(lxcPath, name, "config")},
+		Stdout: &stdout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	config := &lxcConfig{lines: strings.Split(stdout.String(), "\n")}
+	// LXC 2.1 renamed lxc.rootfs to lxc.rootfs.path
+	for _, key := range []string{"lxc.rootfs.path", "lxc.rootfs"} {
+		if spec := config.getProp(key); spec != "" {
+			return spec, nil
+		}
+	}
+	return "", fmt.Errorf("No rootfs in the config of container %s", name)
+}
+
+// rootfsOnHost reports whether the rootfs of a container is a directory that
+// can be used from the host while the container runs.
+func rootfsOnHost(spec string) bool {
+	switch strings.SplitN(spec, ":", 2)[0] {
+	case "dir", "btrfs":
+		return true
+	}
+	return strings.HasPrefix(spec, "/")
+}
+
+// mountRootfs makes the rootfs of a stopped container available on the host.
+func mountRootfs(ctx context.Context, driver Driver, lxcPath string, name string) (*rootfsMount, error) {
+	spec, err := rootfsSpec(ctx, driver, lxcPath, name)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading rootfs of container: %s", err)
+	}
+
+	m := &rootfsMount{driver: driver}
+	if rootfsOnHost(spec) {
+		m.Path = spec
+		if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+			m.Path = parts[1]
+		}
+		return m, nil
+	}
+
+	m.Path = filepath.Join(lxcPath, name, "rootfs")
+	if sudo(ctx, driver, "mountpoint", "-q", m.Path) == nil {
+		// Already mounted, like zfs datasets with a mountpoint
+		return m, nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Unknown rootfs: %s", spec)
+	}
+
+	var args []string
+	switch source := parts[1]; parts[0] {
+	case "lvm":
+		args = []string{"mount", source, m.Path}
+	case "loop":
+		args = []string{"mount", "-o", "loop", source, m.Path}
+	case "rbd":
+		args = []string{"mount", filepath.Join("/dev/rbd", source), m.Path}
+	case "zfs":
+		args = []string{"mount", "-t", "zfs", "-o", "zfsutil", source, m.Path}
+	case "overlay", "overlayfs":
+		dirs := strings.SplitN(source, ":", 2)
+		if len(dirs) != 2 {
+			return nil, fmt.Errorf("Unknown overlay rootfs: %s", spec)
+		}
+		options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+			dirs[0], dirs[1], filepath.Join(filepath.Dir(dirs[1]), "olwork"))
+		args = []string{"mount", "-t", "overlay", "overlay", "-o", options, m.Path}
+	default:
+		return nil, fmt.Errorf("Mounting a %s rootfs is not supported", parts[0])
+	}
+
+	log.Printf("Mounting rootfs %s on %s", spec, m.Path)
+	if err := sudo(ctx, driver, args...); err != nil {
+		return nil, fmt.Errorf("Error mounting rootfs: %s", err)
+	}
+	m.mounted = true
+	return m, nil
+}
+
+// Unmount unmounts the rootfs if mountRootfs mounted it.
+func (m *rootfsMount) Unmount(ctx context.Context) error {
+	if !m.mounted {
+		return nil
+	}
+
+	log.Printf("Unmounting rootfs %s", m.Path)
+	if err := sudo(ctx, m.driver, "umount", m.Path); err != nil {
+		return fmt.Errorf("Error unmounting rootfs: %s", err)
+	}
+	m.mounted = false
+	return nil
+}
@@ -0,0 +1,121 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum number of symlinks followed while resolving a single path, the
+// same limit the linux kernel uses.
+const maxSymlinks = 40
+
+// readlinkFunc reports whether path is a symlink and, if so, its target.
+type readlinkFunc func(path string) (target string, isLink bool, err error)
+
+// resolveInRoot resolves unsafePath as if root was the filesystem root, the
+// way a chroot would. Symlinks are followed relative to root and the result
+// is guaranteed to stay inside of it, any attempt to escape is an error.
+func resolveInRoot(root string, unsafePath string, readlink readlinkFunc) (string, error) {
+	root = filepath.Clean(root)
+	resolved := ""
+	remaining := filepath.ToSlash(unsafePath)
+	links := 0
+
+	for remaining != "" {
+		part := remaining
+		remaining = ""
+		if i := strings.Index(part, "/"); i != -1 {
+			part, remaining = part[:i], part[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return "", fmt.Errorf("Path '%s' escapes the container rootfs", unsafePath)
+			}
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		target, isLink, err := readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !isLink {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Too many levels of symbolic links in '%s'", unsafePath)
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = filepath.ToSlash(target) + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// hostReadlink reads a symlink on the host, with sudo when the path is only
+// accessible to root.
+func hostReadlink(ctx context.Context, driver Driver, path string) (string, bool, error) {
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return "", false, nil
+		}
+		target, err := os.Readlink(path)
+		return target, true, err
+	}
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if !os.IsPermission(err) {
+		return "", false, err
+	}
+
+	// Most of the rootfs is only readable by root, fall back to sudo.
+	var stdout bytes.Buffer
+	err = driver.SudoCommand(ctx, &HostCmd{
+		Args:   []string{"readlink", path},
+		Stdout: &stdout,
+	})
+	if err != nil {
+		// readlink exits non-zero for anything that is not a symlink
+		return "", false, nil
+	}
+	return strings.TrimRight(stdout.String(), "\n"), true, nil
+}
+
+// hostExists reports whether path exists on the host, without following a
+// final symlink, with sudo when the path is only accessible to root.
+func hostExists(ctx context.Context, driver Driver, path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if !os.IsPermission(err) {
+		return false, err
+	}
+
+	err = driver.SudoCommand(ctx, &HostCmd{
+		Args: []string{"sh", "-c", `test -e "$1" || test -L "$1"`, "sh", path},
+	})
+	return err == nil, nil
+}
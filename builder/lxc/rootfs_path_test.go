@@ -0,0 +1,58 @@
+package lxc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "rootfs")
+	testFiles(t, root, "etc/hostname", "usr/lib/")
+
+	links := map[string]string{
+		"lib":      "usr/lib",
+		"abs":      "/usr/lib",
+		"up":       "../../..",
+		"etc/self": "../etc",
+		"loop":     "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{"/etc/hostname", "etc/hostname", false},
+		{"etc/./hostname", "etc/hostname", false},
+		{"/lib/modules", "usr/lib/modules", false},
+		{"/abs/modules", "usr/lib/modules", false},
+		{"/etc/self/self/hostname", "etc/hostname", false},
+		{"/up/etc", "", true},
+		{"/usr/../etc", "etc", false},
+		{"/", "", false},
+		{"/..", "", true},
+		{"/loop/x", "", true},
+	}
+	for _, c := range cases {
+		resolved, err := resolveInRoot(root, c.path, localReadlink)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: resolved to %s, expected an error", c.path, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+		} else if want := filepath.Join(root, c.want); resolved != want {
+			t.Errorf("%s: resolved to %s, want %s", c.path, resolved, want)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Annotation of the manifests in an OCI index naming the image
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// dockerImageID is the name of the config in a docker archive, the sha256 of
+// its content.
+var dockerImageID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ociImageConfig is the part of the image config that is used for the
+// container config.
+type ociImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		User       string
+		Env        []string
+		Entrypoint []string
+		Cmd        []string
+		WorkingDir string
+	} `json:"config"`
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ociLayer is a layer of an image. Layers of an OCI layout are verified
+// against their digest, layers of a docker archive against the digest of
+// their uncompressed content, the diff id.
+type ociLayer struct {
+	Path   string
+	Digest string
+	DiffID string
+}
+
+// ociImage is an image read from an OCI image layout or a docker save
+// archive. Archives are extracted to a temporary directory until Close.
+type ociImage struct {
+	Config ociImageConfig
+	Layers []ociLayer
+
+	tmpDir string
+}
+
+// openOciImage reads the image named ref, which can be empty if there is a
+// single image, from an OCI image layout or docker save archive. Both can be
+// a directory or a tar archive.
+func openOciImage(ctx context.Context, source string, ref string) (*ociImage, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	image := &ociImage{}
+	dir := source
+	if !fi.IsDir() {
+		image.tmpDir, err = ioutil.TempDir("", "packer-oci")
+		if err != nil {
+			return nil, err
+		}
+		dir = image.tmpDir
+
+		log.Printf("Extracting image archive %s to %s", source, dir)
+		if err := extractImageFile(ctx, source, dir); err != nil {
+			image.Close()
+			return nil, fmt.Errorf("Error extracting image archive: %s", err)
+		}
+	}
+
+	// docker save writes a manifest.json, since docker 25 next to an OCI
+	// layout, so it is read first.
+	if _, err = os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		err = image.readDocker(dir, ref)
+	} else {
+		err = image.readLayout(dir, ref)
+	}
+	if err != nil {
+		image.Close()
+		return nil, err
+	}
+	return image, nil
+}
+
+// extractImageFile extracts the image archive in source to dir, stopping
+// when ctx is done.
+func extractImageFile(ctx context.Context, source string, dir string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return extractImage(&ctxReader{ctx: ctx, r: f}, dir)
+}
+
+// ctxReader fails reading once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (i *ociImage) readDocker(dir string, ref string) error {
+	var manifests []dockerManifest
+	if err := readJSON(filepath.Join(dir, "manifest.json"), &manifests); err != nil {
+		return err
+	}
+
+	var manifest *dockerManifest
+	for n, m := range manifests {
+		if ref == "" && len(manifests) == 1 {
+			manifest = &manifests[n]
+		}
+		for _, tag := range m.RepoTags {
+			if ref != "" && tag == ref {
+				manifest = &manifests[n]
+			}
+		}
+	}
+	if manifest == nil {
+		return imageNotFound(ref, len(manifests))
+	}
+
+	configPath, err := archivePath(dir, manifest.Config)
+	if err != nil {
+		return err
+	}
+	// The config is named after its digest, it has the digests of the layers
+	id := strings.TrimSuffix(filepath.Base(configPath), ".json")
+	if !dockerImageID.MatchString(id) {
+		return fmt.Errorf("Config %s of the image is not named after its digest", manifest.Config)
+	}
+	if err := verifyDigest(configPath, "sha256:"+id, false); err != nil {
+		return err
+	}
+	if err := readJSON(configPath, &i.Config); err != nil {
+		return err
+	}
+
+	diffIDs := i.Config.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("The image has %d layers, but its config %d diff ids", len(manifest.Layers), len(diffIDs))
+	}
+	for n, layer := range manifest.Layers {
+		layerPath, err := archivePath(dir, layer)
+		if err != nil {
+			return err
+		}
+		i.Layers = append(i.Layers, ociLayer{Path: layerPath, DiffID: diffIDs[n]})
+	}
+	return nil
+}
+
+func (i *ociImage) readLayout(dir string, ref string) error {
+	var index ociIndex
+	if err := readJSON(filepath.Join(dir, "index.json"), &index); err != nil {
+		return fmt.Errorf("Neither an OCI image layout nor a docker archive: %s", err)
+	}
+
+	var descriptor *ociDescriptor
+	for n, d := range index.Manifests {
+		if (ref == "" && len(index.Manifests) == 1) || (ref != "" && d.Annotations[ociRefName] == ref) {
+			descriptor = &index.Manifests[n]
+		}
+	}
+	if descriptor == nil {
+		return imageNotFound(ref, len(index.Manifests))
+	}
+
+	var manifest ociManifest
+	for {
+		if err := readBlob(dir, *descriptor, &manifest); err != nil {
+			return err
+		}
+		if len(manifest.Manifests) == 0 {
+			break
+		}
+
+		// A multi-platform image, pick the manifest for this host
+		descriptor = nil
+		for n, d := range manifest.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+				descriptor = &manifest.Manifests[n]
+				break
+			}
+		}
+		if descriptor == nil {
+			return fmt.Errorf("No linux/%s image in the image index", runtime.GOARCH)
+		}
+		manifest = ociManifest{}
+	}
+
+	if err := readBlob(dir, manifest.Config, &i.Config); err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.Layers {
+		layerPath, err := blobPath(dir, layer.Digest)
+		if err != nil {
+			return err
+		}
+		i.Layers = append(i.Layers, ociLayer{Path: layerPath, Digest: layer.Digest})
+	}
+	return nil
+}
+
+// Close removes the extracted archive.
+func (i *ociImage) Close() error {
+	if i.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(i.tmpDir)
+}
+
+func imageNotFound(ref string, count int) error {
+	if ref == "" {
+		return fmt.Errorf("Found %d images, source_oci.ref must name one of them", count)
+	}
+	return fmt.Errorf("Image %s not found", ref)
+}
+
+// archivePath returns the path of a file named in a docker archive, which
+// must stay inside of it.
+func archivePath(dir string, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || clean != "/"+strings.TrimPrefix(name, "/") {
+		return "", fmt.Errorf("Invalid path in image archive: %s", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout.
+func blobPath(dir string, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("Invalid digest: %s", digest)
+	}
+	return filepath.Join(dir, "blobs", parts[0], parts[1]), nil
+}
+
+// readBlob verifies a JSON blob of an OCI image layout against its digest
+// and decodes it into v.
+func readBlob(dir string, descriptor ociDescriptor, v interface{}) error {
+	blob, err := blobPath(dir, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	if err := verifyDigest(blob, descriptor.Digest, false); err != nil {
+		return err
+	}
+	return readJSON(blob, v)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error parsing %s: %s", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// verifyDigest checks a file, or its decompressed content if uncompressed is
+// set, against a digest like sha256:<hex>.
+func verifyDigest(path string, digest string, uncompressed bool) error {
+	var h hash.Hash
+	switch strings.SplitN(digest, ":", 2)[0] {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("Unsupported digest: %s", digest)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if uncompressed {
+		var closer func()
+		r, closer, err = decompress(f)
+		if err != nil {
+			return err
+		}
+		defer closer()
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+
+	if actual := strings.SplitN(digest, ":", 2)[0] + ":" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("Digest mismatch of %s: expected %s, got %s", filepath.Base(path), digest, actual)
+	}
+	return nil
+}
+
+// applyLayer verifies a layer and extracts it to the rootfs, applying its
+// whiteouts to the layers below it.
+func applyLayer(ctx context.Context, driver Driver, rootfs string, layer ociLayer) error {
+	if layer.Digest != "" {
+		if err := verifyDigest(layer.Path, layer.Digest, false); err != nil {
+			return err
+		}
+	}
+	if layer.DiffID != "" {
+		if err := verifyDigest(layer.Path, layer.DiffID, true); err != nil {
+			return err
+		}
+	}
+	return extractLayer(ctx, driver, layer.Path, rootfs)
+}
+
+// setImageConfig adds the environment, command, user and working directory
+// of the image to the container config. The keys were renamed in LXC 2.1,
+// the new ones are used if the config already does.
+func setImageConfig(ctx context.Context, driver Driver, config *lxcConfig, rootfs string, image ociImageConfig) error {
+	newKeys := config.getProp("lxc.rootfs.path") != "" || config.getProp("lxc.uts.name") != ""
+	key := func(new string, old string) string {
+		if newKeys {
+			return new
+		}
+		return old
+	}
+
+	for _, env := range image.Config.Env {
+		config.lines = append(config.lines, "lxc.environment = "+env)
+	}
+
+	command := append(append([]string{}, image.Config.Entrypoint...), image.Config.Cmd...)
+	if len(command) > 0 {
+		// LXC splits the command at spaces outside of quotes
+		config.setProp(key("lxc.init.cmd", "lxc.init_cmd"), ShellJoin(command...))
+	}
+
+	if image.Config.User != "" {
+		uid, gid, err := imageUser(ctx, driver, rootfs, image.Config.User)
+		if err != nil {
+			return err
+		}
+		config.setProp(key("lxc.init.uid", "lxc.init_uid"), uid)
+		if gid != "" {
+			config.setProp(key("lxc.init.gid", "lxc.init_gid"), gid)
+		}
+	}
+
+	if image.Config.WorkingDir != "" {
+		config.setProp(key("lxc.init.cwd", "lxc.init_cwd"), image.Config.WorkingDir)
+	}
+	return nil
+}
+
+// imageUser resolves the user of an image, like 1000, app or app:staff, to a
+// uid and gid through the passwd and group files of the rootfs.
+func imageUser(ctx context.Context, driver Driver, rootfs string, user string) (string, string, error) {
+	parts := strings.SplitN(user, ":", 2)
+	uid, gid := parts[0], ""
+	if len(parts) == 2 {
+		gid = parts[1]
+	}
+
+	uidNumeric, gidNumeric := isNumeric(uid), isNumeric(gid)
+	if !uidNumeric || gid == "" {
+		entry, err := lookupEntry(ctx, driver, filepath.Join(rootfs, "etc", "passwd"), uid)
+		if err != nil && uidNumeric {
+			// Images without a passwd file, like scratch images, use ids
+			entry, err = nil, nil
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("Error looking up image user %s: %s", uid, err)
+		}
+		if entry != nil {
+			uid = entry[2]
+			if gid == "" {
+				gid, gidNumeric = entry[3], true
+			}
+		} else if !uidNumeric {
+			return "", "", fmt.Errorf("Image user %s not found in /etc/passwd", uid)
+		}
+	}
+
+	if gid != "" && !gidNumeric {
+		entry, err := lookupEntry(ctx, driver, filepath.Join(rootfs, "etc", "group"), gid)
+		if err != nil {
+			return "", "", fmt.Errorf("Error looking up image group %s: %s", gid, err)
+		}
+		if entry == nil {
+			return "", "", fmt.Errorf("Image group %s not found in /etc/group", gid)
+		}
+		gid = entry[2]
+	}
+	return uid, gid, nil
+}
+
+// isNumeric returns if a user or group is given as an id.
+func isNumeric(id string) bool {
+	_, err := strconv.Atoi(id)
+	return err == nil
+}
+
+// lookupEntry finds the entry of a name or id in a passwd or group file.
+func lookupEntry(ctx context.Context, driver Driver, file string, name string) ([]string, error) {
+	var stdout bytes.Buffer
+	if err := driver.SudoCommand(ctx, &HostCmd{Args: []string{"cat", file}, Stdout: &stdout}); err != nil {
+		return nil, err
+	}
+
+	var byID []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[0] == name {
+			return fields, nil
+		}
+		if fields[2] == name && byID == nil {
+			byID = fields
+		}
+	}
+	return byID, nil
+}
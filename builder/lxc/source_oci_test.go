@@ -0,0 +1,261 @@
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDockerArchive writes the directory of a docker save archive with one
+// layer and returns the layer.
+func testDockerArchive(t *testing.T, dir string, cmd []string) []byte {
+	layer := testTar(t, tarEntry{Name: "etc/hostname", Typeflag: tar.TypeReg, Content: "oci\n"}).Bytes()
+	diffID := sha256.Sum256(layer)
+
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Cmd": cmd},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{"sha256:" + hex.EncodeToString(diffID[:])},
+		},
+	}
+	configData, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configID := sha256.Sum256(configData)
+	configName := hex.EncodeToString(configID[:]) + ".json"
+
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   configName,
+		RepoTags: []string{"packer:latest"},
+		Layers:   []string{"layer/layer.tar"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		configName:        configData,
+		"manifest.json":   manifest,
+		"layer/layer.tar": layer,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return layer
+}
+
+func TestOpenOciImage_docker(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	testDockerArchive(t, dir, []string{"/bin/true"})
+
+	image, err := openOciImage(context.Background(), dir, "packer:latest")
+	if err != nil {
+		t.Fatalf("openOciImage: %s", err)
+	}
+	defer image.Close()
+
+	if len(image.Layers) != 1 || image.Layers[0].DiffID == "" {
+		t.Fatalf("unexpected layers: %#v", image.Layers)
+	}
+	if err := verifyDigest(image.Layers[0].Path, image.Layers[0].DiffID, true); err != nil {
+		t.Errorf("verifyDigest: %s", err)
+	}
+
+	// A layer that was changed doesn't match its diff id anymore
+	if err := ioutil.WriteFile(image.Layers[0].Path, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = applyLayer(context.Background(), new(MockDriver), filepath.Join(dir, "rootfs"), image.Layers[0])
+	if err == nil || !strings.Contains(err.Error(), "Digest mismatch") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+}
+
+func TestOpenOciImage_dockerArchive(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	imageDir := filepath.Join(dir, "image")
+	testDockerArchive(t, imageDir, []string{"/bin/true"})
+
+	// docker save writes the files owned by root, and read-only directories
+	// must not keep the layers from being extracted
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.Walk(imageDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == imageDir {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, _ = filepath.Rel(imageDir, path)
+		hdr.Uid, hdr.Gid = 0, 0
+		if fi.IsDir() {
+			hdr.Mode = 0555
+		}
+		if err := tw.WriteHeader(hdr); err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := openOciImage(context.Background(), archive, "")
+	if err != nil {
+		t.Fatalf("openOciImage: %s", err)
+	}
+	if len(image.Layers) != 1 {
+		t.Errorf("unexpected layers: %#v", image.Layers)
+	} else if err := verifyDigest(image.Layers[0].Path, image.Layers[0].DiffID, true); err != nil {
+		t.Errorf("verifyDigest: %s", err)
+	}
+	tmpDir := image.tmpDir
+	if err := image.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("extracted image left behind: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := openOciImage(ctx, archive, ""); err == nil {
+		t.Errorf("opened an image with a cancelled context")
+	}
+}
+
+func TestImageUser(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/sh\napp:x:1000:100::/home/app:/bin/sh\n"
+	group := "root:x:0:\nusers:x:100:\nstaff:x:50:app\n"
+	cases := []struct {
+		user     string
+		noPasswd bool
+		uid      string
+		gid      string
+		err      string
+	}{
+		{"app", false, "1000", "100", ""},
+		{"app:staff", false, "1000", "50", ""},
+		{"app:50", false, "1000", "50", ""},
+		{"1000", false, "1000", "100", ""},
+		{"1000:staff", false, "1000", "50", ""},
+		{"2000", false, "2000", "", ""},
+		{"2000:3000", true, "2000", "3000", ""},
+		{"2000", true, "2000", "", ""},
+		{"nobody", false, "", "", "not found in /etc/passwd"},
+		{"nobody", true, "", "", "Error looking up image user"},
+		{"app:wheel", false, "", "", "not found in /etc/group"},
+	}
+	for _, c := range cases {
+		noPasswd := c.noPasswd
+		driver := &MockDriver{SudoFn: func(cmd *HostCmd) error {
+			switch {
+			case noPasswd:
+				return errors.New("No such file or directory")
+			case strings.HasSuffix(cmd.Args[1], "/etc/passwd"):
+				io.WriteString(cmd.Stdout, passwd)
+			case strings.HasSuffix(cmd.Args[1], "/etc/group"):
+				io.WriteString(cmd.Stdout, group)
+			}
+			return nil
+		}}
+
+		uid, gid, err := imageUser(context.Background(), driver, "/rootfs", c.user)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected %q, got %v", c.user, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.user, err)
+		} else if uid != c.uid || gid != c.gid {
+			t.Errorf("%s: %s:%s, want %s:%s", c.user, uid, gid, c.uid, c.gid)
+		}
+	}
+}
+
+func TestOpenOciImage_dockerConfigChanged(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	testDockerArchive(t, dir, []string{"/bin/true"})
+
+	configs, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range configs {
+		if filepath.Base(config) != "manifest.json" {
+			ioutil.WriteFile(config, []byte(`{"rootfs":{"diff_ids":["sha256:00"]}}`), 0644)
+		}
+	}
+
+	if _, err := openOciImage(context.Background(), dir, ""); err == nil {
+		t.Errorf("opened an image with a changed config")
+	}
+}
+
+func TestSetImageConfig(t *testing.T) {
+	cases := []struct {
+		lines []string
+		cmd   []string
+		want  string
+	}{
+		{
+			[]string{"lxc.rootfs.path = dir:/rootfs"},
+			[]string{"/bin/sh", "-c", "echo hello world"},
+			"lxc.init.cmd = /bin/sh -c 'echo hello world'",
+		},
+		{
+			[]string{"lxc.rootfs = /rootfs"},
+			[]string{"/usr/bin/app"},
+			"lxc.init_cmd = /usr/bin/app",
+		},
+	}
+	for _, c := range cases {
+		config := &lxcConfig{lines: c.lines}
+		var image ociImageConfig
+		image.Config.Cmd = c.cmd
+		if err := setImageConfig(context.Background(), nil, config, "/rootfs", image); err != nil {
+			t.Fatalf("setImageConfig: %s", err)
+		}
+		if got := config.lines[len(config.lines)-1]; got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
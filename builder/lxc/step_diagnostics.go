@@ -0,0 +1,154 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+)
+
+// How long a single diagnostics command may take
+const diagnosticsTimeout = 30 * time.Second
+
+// stepDiagnostics collects a diagnostics bundle about the container when the
+// build fails, before the container and output directory are cleaned up.
+type stepDiagnostics struct{}
+
+func (s *stepDiagnostics) Run(state multistep.StateBag) multistep.StepAction {
+	return multistep.ActionContinue
+}
+
+func (s *stepDiagnostics) Cleanup(state multistep.StateBag) {
+	_, failed := state.GetOk("error")
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !failed && !halted {
+		return
+	}
+
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	// diagnostics_directory may hold anything, every bundle gets a new
+	// directory in it instead of replacing what is there
+	dir := filepath.Join(config.DiagnosticsDir, time.Now().Format("20060102-150405"))
+	err := os.MkdirAll(config.DiagnosticsDir, 0755)
+	if err == nil {
+		err = os.Mkdir(dir, 0755)
+	}
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error collecting diagnostics: %s", err))
+		return
+	}
+
+	ui.Say(fmt.Sprintf("Collecting diagnostics into: %s", dir))
+	if err := s.collect(state, dir); err != nil {
+		ui.Error(fmt.Sprintf("Error collecting diagnostics: %s", err))
+	}
+}
+
+func (s *stepDiagnostics) collect(state multistep.StateBag, dir string) error {
+	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
+	name := config.ContainerName
+	containerDir := filepath.Join(config.LxcPath, name)
+
+	write := func(filename string, content []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), content, 0644); err != nil {
+			log.Printf("Error writing diagnostics file %s: %s", filename, err)
+		}
+	}
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		write("error.txt", []byte(rawErr.(error).Error()+"\n"))
+	}
+	if lastCommand, ok := state.GetOk("last_command"); ok {
+		write("last-command.txt", []byte(lastCommand.(string)+"\n"))
+	}
+
+	info, err := s.info(driver, name)
+	if err != nil {
+		// Creating the container failed, only the logs are left
+		write("lxc-info.txt", []byte(fmt.Sprintf("Error reading container info: %s\n", err)))
+	} else {
+		write("lxc-info.txt", s.formatInfo(info))
+	}
+	running := err == nil && info.State == "RUNNING"
+
+	if running {
+		write("ps.txt", s.attachOutput(driver, name,
+			"/bin/sh", "-c", "ps auxf 2>/dev/null || ps -ef 2>/dev/null || ps"))
+	}
+	if _, ok := driver.(FileDriver); ok {
+		// There is no lxc config and rootfs of the container on the host
+		if running {
+			write("disk-usage.txt", s.attachOutput(driver, name, "df", "-h", "/"))
+		}
+	} else if err == nil {
+		write("config", s.sudoOutput(driver, "cat", filepath.Join(containerDir, "config")))
+		write("disk-usage.txt", s.sudoOutput(driver, "sh", "-c",
+			ShellJoin("du", "-sh", filepath.Join(containerDir, "rootfs"))+"; "+
+				ShellJoin("df", "-h", filepath.Join(containerDir, "rootfs"))))
+	}
+
+	for _, key := range []string{"console_log", "lxc_log"} {
+		if path, ok := state.GetOk(key); ok {
+			write(filepath.Base(path.(string)), s.sudoOutput(driver, "cat", path.(string)))
+		}
+	}
+
+	return nil
+}
+
+func (s *stepDiagnostics) info(driver Driver, name string) (*ContainerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+	return driver.Info(ctx, name)
+}
+
+func (s *stepDiagnostics) formatInfo(info *ContainerInfo) []byte {
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "Name:  %s\n", info.Name)
+	fmt.Fprintf(&output, "State: %s\n", info.State)
+	fmt.Fprintf(&output, "PID:   %d\n", info.Pid)
+	for _, ip := range info.IPs {
+		fmt.Fprintf(&output, "IP:    %s\n", ip)
+	}
+	return output.Bytes()
+}
+
+// sudoOutput runs a command as root on the host and returns its combined
+// output. Errors are appended to the output, a partial bundle is better than
+// none.
+func (s *stepDiagnostics) sudoOutput(driver Driver, args ...string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	err := driver.SudoCommand(ctx, &HostCmd{Args: args, Stdout: &output, Stderr: &output})
+	if err != nil {
+		fmt.Fprintf(&output, "\nError running %s: %s\n", ShellJoin(args...), err)
+	}
+	return output.Bytes()
+}
+
+// attachOutput is like sudoOutput, but runs the command in the container.
+func (s *stepDiagnostics) attachOutput(driver Driver, name string, args ...string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	exitStatus, err := driver.Attach(ctx, name, &AttachCmd{Args: args, Stdout: &output, Stderr: &output})
+	if err != nil {
+		fmt.Fprintf(&output, "\nError running %s: %s\n", ShellJoin(args...), err)
+	} else if exitStatus != 0 {
+		fmt.Fprintf(&output, "\n%s exited with %d\n", ShellJoin(args...), exitStatus)
+	}
+	return output.Bytes()
+}
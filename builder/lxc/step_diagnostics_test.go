@@ -0,0 +1,47 @@
+package lxc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepDiagnostics(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	raw := testConfig(t, dir)
+	// Whatever is in the directory already stays
+	diagnosticsDir := raw["diagnostics_directory"].(string)
+	testFiles(t, diagnosticsDir, "unrelated")
+
+	state, driver, ui := testState(t, raw)
+	driver.setState("packer-test", "STOPPED")
+
+	step := new(stepDiagnostics)
+	step.Cleanup(state)
+	if entries, _ := ioutil.ReadDir(diagnosticsDir); len(entries) != 1 {
+		t.Fatalf("diagnostics collected for a successful build:\n%s", ui)
+	}
+
+	state.Put("error", errors.New("provisioning failed"))
+	state.Put(multistep.StateHalted, true)
+	step.Cleanup(state)
+
+	if _, err := os.Stat(filepath.Join(diagnosticsDir, "unrelated")); err != nil {
+		t.Errorf("existing file removed: %s", err)
+	}
+	bundles, err := filepath.Glob(filepath.Join(diagnosticsDir, "*", "error.txt"))
+	if err != nil || len(bundles) != 1 {
+		t.Fatalf("no bundle collected: %v\n%s", err, ui)
+	}
+	if content, _ := ioutil.ReadFile(bundles[0]); string(content) != "provisioning failed\n" {
+		t.Errorf("error.txt = %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(bundles[0]), "lxc-info.txt")); err != nil {
+		t.Errorf("lxc-info.txt missing: %s", err)
+	}
+}
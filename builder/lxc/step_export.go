@@ -1,33 +1,37 @@
 package lxc
 
 import (
-	"github.com/mitchellh/multistep"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/packer/packer"
-	"bytes"
-	"os/exec"
-	"log"
-	"strings"
-	"path/filepath"
-	"os"
+	"github.com/mitchellh/multistep"
 	"io"
-	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
 )
 
-type stepExport struct{}
+type stepExport struct {
+	// fingerprint is the image published by the build, it is deleted when
+	// the build fails after all.
+	fingerprint string
+}
 
 type Metadata struct {
 	Provider string `json:"provider"`
-	Version string  `json:"version"`
+	Version  string `json:"version"`
 }
 
 func (s *stepExport) Run(state multistep.StateBag) multistep.StepAction {
+	ctx := state.Get("context").(context.Context)
 	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	name := config.ContainerName
 
-	containerDir := filepath.Join(LxcDir, name)
+	containerDir := filepath.Join(config.LxcPath, name)
 	configFilePath := filepath.Join(config.OutputDir, "lxc-config")
 	metadataFilePath := filepath.Join(config.OutputDir, "metadata.json")
 
@@ -79,23 +83,53 @@ func (s *stepExport) Run(state multistep.StateBag) multistep.StepAction {
 
 	_, err = io.Copy(configFile, originalConfigFile)
 
-	commands := make([][]string, 4)
-	commands[0] = []string{
-		"lxc-stop", "--name", name,
+	ui.Say("Stopping container...")
+	if err := driver.Stop(ctx, name); err != nil {
+		err := fmt.Errorf("Error stopping container: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
 	}
 
+	if images, ok := driver.(ImageDriver); ok {
+		return s.publish(state, images)
+	}
+
+	rootfs, err := mountRootfs(ctx, driver, config.LxcPath, name)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer rootfs.Unmount(context.Background())
+
+	if err := s.removeSidedisks(ctx, driver, rootfs.Path, config.SidediskFolders, ui); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	commands := make([][]string, 3)
+
 	filename := "rootfs.tar.gz"
 	if config.ExportConfig.Filename != "" {
 		filename = config.ExportConfig.Filename
 	}
+	// The archive is opened relative to the working directory, not -C
+	outputPath := filepath.Join(config.OutputDir, filename)
 	if len(config.ExportConfig.Folders) == 0 {
-		commands[1] = []string{
-			"tar", "-C", containerDir, "--numeric-owner", "--anchored", "--exclude=./rootfs/dev/log", "-czf", filename, "./rootfs",
+		commands[0] = []string{
+			"tar", "-C", containerDir, "--numeric-owner", "--anchored", "--exclude=./rootfs/dev/log", "-czf", outputPath, "./rootfs",
+		}
+		if rootfs.Path != filepath.Join(containerDir, "rootfs") {
+			// The rootfs is stored elsewhere, still export it as ./rootfs
+			commands[0] = []string{
+				"tar", "-C", rootfs.Path, "--numeric-owner", "--anchored", "--exclude=./dev/log", "--transform", "s,^\\.,./rootfs,", "-czf", outputPath, ".",
+			}
 		}
 	} else {
 		ui.Say("Preparing folders to export...")
-		outputPath := filepath.Join(config.OutputDir, filename)
-		err, exportFolder := s.PrepareExport(containerDir, config.ExportConfig.Folders)
+		err, exportFolder := s.PrepareExport(ctx, driver, rootfs.Path, config.ExportConfig.Folders)
 		if err != nil {
 			err := fmt.Errorf("Error creating container export folder: %s", err)
 			state.Put("error", err)
@@ -105,19 +139,19 @@ func (s *stepExport) Run(state multistep.StateBag) multistep.StepAction {
 		command := []string{
 			"tar", "-C", exportFolder, "--anchored", "-czf", outputPath, ".",
 		}
-		commands[1] = command
+		commands[0] = command
 	}
 
-	commands[2] = []string{
+	commands[1] = []string{
 		"chmod", "+x", configFilePath,
 	}
-	commands[3] = []string{
+	commands[2] = []string{
 		"sh", "-c", "chown $USER:`id -gn` " + filepath.Join(config.OutputDir, "*"),
 	}
 
 	ui.Say("Exporting container...")
 	for _, command := range commands {
-		err := s.SudoCommand(command...)
+		err := sudo(ctx, driver, command...)
 		if err != nil {
 			err := fmt.Errorf("Error exporting container: %s", err)
 			state.Put("error", err)
@@ -126,27 +160,98 @@ func (s *stepExport) Run(state multistep.StateBag) multistep.StepAction {
 		}
 	}
 
+	if err := rootfs.Unmount(ctx); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// removeSidedisks removes the sidedisks that don't persist from the rootfs of
+// the stopped container. Bind mounts are already gone with the container.
+func (s *stepExport) removeSidedisks(ctx context.Context, driver Driver, rootfs string, sidedisks []SidediskFolder, ui packer.Ui) error {
+	readlink := func(path string) (string, bool, error) {
+		return hostReadlink(ctx, driver, path)
+	}
+
+	for _, sidedisk := range sidedisks {
+		if sidedisk.Persistent() || sidedisk.Type == SidediskBind {
+			continue
+		}
+
+		ui.Say(fmt.Sprintf("Removing sidedisk %s...", sidedisk.Dest))
+		// Provisioning may have replaced it with a symlink, which is removed
+		// itself instead of what it points to
+		dest := path.Clean("/" + sidedisk.Dest)
+		parent, err := resolveInRoot(rootfs, path.Dir(dest), readlink)
+		if err != nil {
+			return fmt.Errorf("Error resolving sidedisk %s: %s", sidedisk.Dest, err)
+		}
+		if err := sudo(ctx, driver, "rm", "-rf", "--", filepath.Join(parent, path.Base(dest))); err != nil {
+			return fmt.Errorf("Error removing sidedisk %s: %s", sidedisk.Dest, err)
+		}
+	}
+	return nil
+}
+
+// publish exports the container as an image of the driver.
+func (s *stepExport) publish(state multistep.StateBag, images ImageDriver) multistep.StepAction {
+	ctx := state.Get("context").(context.Context)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	filename := "image.tar.gz"
+	if config.ExportConfig.Filename != "" {
+		filename = config.ExportConfig.Filename
+	}
+
+	ui.Say("Publishing container as image...")
+	image, err := os.Create(filepath.Join(config.OutputDir, filename))
+	if err == nil {
+		opts := PublishOptions{
+			Alias:   config.ExportConfig.ImageAlias,
+			Replace: config.PackerForce,
+		}
+		s.fingerprint, err = images.Publish(ctx, config.ContainerName, opts, image)
+		if closeErr := image.Close(); err == nil {
+			err = closeErr
+		}
+		if s.fingerprint != "" {
+			ui.Message(fmt.Sprintf("Image fingerprint: %s", s.fingerprint))
+		}
+	}
+	if err != nil {
+		err := fmt.Errorf("Error exporting container: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	return multistep.ActionContinue
 }
 
-func (s *stepExport) PrepareExport(containerDir string, exportFolders []ExportFolder) (error, string) {
-	containerDir = filepath.Join(containerDir, "rootfs")
-	exportFolder := filepath.Join(containerDir, "lxc-export-container-dir")
-	err := s.SudoCommand("mkdir", "-p", exportFolder)
+// PrepareExport moves the exported folders to a directory in the rootfs. The
+// src of a folder is a path in the rootfs, which is mounted on the host for
+// backing stores other than a directory.
+func (s *stepExport) PrepareExport(ctx context.Context, driver Driver, rootfs string, exportFolders []ExportFolder) (error, string) {
+	exportFolder := filepath.Join(rootfs, "lxc-export-container-dir")
+	err := sudo(ctx, driver, "mkdir", "-p", exportFolder)
 	if err != nil {
-		return nil, exportFolder
+		return err, exportFolder
 	}
 	for i := 0; i < len(exportFolders); i++ {
-		src := filepath.Join(containerDir, exportFolders[i].Src)
+		src := filepath.Join(rootfs, exportFolders[i].Src)
 		dest := filepath.Join(exportFolder, exportFolders[i].Dest)
 		destFolder := filepath.Dir(dest)
 		if destFolder != exportFolder {
-			err := s.SudoCommand("mkdir", "-p", destFolder)
+			err := sudo(ctx, driver, "mkdir", "-p", destFolder)
 			if err != nil {
 				return err, exportFolder
 			}
 		}
-		err := s.SudoCommand("mv", src, dest)
+		err := sudo(ctx, driver, "mv", src, dest)
 		if err != nil {
 			return err, exportFolder
 		}
@@ -154,27 +259,23 @@ func (s *stepExport) PrepareExport(containerDir string, exportFolders []ExportFo
 	return nil, exportFolder
 }
 
-func (s *stepExport) Cleanup(state multistep.StateBag) {}
-
-
-func (s *stepExport) SudoCommand(args ...string) error {
-	var stdout, stderr bytes.Buffer
-
-	log.Printf("Executing sudo command: %#v", args)
-	cmd := exec.Command("sudo", args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
-
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("Sudo command error: %s", stderrString)
+func (s *stepExport) Cleanup(state multistep.StateBag) {
+	if s.fingerprint == "" {
+		return
 	}
 
-	log.Printf("stdout: %s", stdoutString)
-	log.Printf("stderr: %s", stderrString)
+	_, failed := state.GetOk("error")
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !failed && !cancelled && !halted {
+		return
+	}
 
-	return err
+	images := state.Get("driver").(ImageDriver)
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say(fmt.Sprintf("Deleting image %s...", s.fingerprint))
+	// The build context may already be cancelled
+	if err := images.DeleteImage(context.Background(), s.fingerprint); err != nil {
+		ui.Error(err.Error())
+	}
 }
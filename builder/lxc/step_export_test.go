@@ -0,0 +1,178 @@
+package lxc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepExport(t *testing.T) {
+	cases := []struct {
+		name    string
+		folders []map[string]interface{}
+		failing string
+		action  multistep.StepAction
+		want    func(dir string) [][]string
+	}{
+		{
+			name:   "rootfs",
+			action: multistep.ActionContinue,
+			want: func(dir string) [][]string {
+				return [][]string{
+					{"tar", "-C", filepath.Join(dir, "lxc", "packer-test"), "--numeric-owner", "--anchored", "--exclude=./rootfs/dev/log", "-czf", filepath.Join(dir, "output", "rootfs.tar.gz"), "./rootfs"},
+				}
+			},
+		},
+		{
+			name:    "folders",
+			folders: []map[string]interface{}{{"src": "/srv/app", "dest": "app/current"}},
+			action:  multistep.ActionContinue,
+			want: func(dir string) [][]string {
+				rootfs := filepath.Join(dir, "lxc", "packer-test", "rootfs")
+				export := filepath.Join(rootfs, "lxc-export-container-dir")
+				return [][]string{
+					{"mkdir", "-p", export},
+					{"mkdir", "-p", filepath.Join(export, "app")},
+					{"mv", filepath.Join(rootfs, "srv", "app"), filepath.Join(export, "app", "current")},
+					{"tar", "-C", export, "--anchored", "-czf", filepath.Join(dir, "output", "rootfs.tar.gz"), "."},
+				}
+			},
+		},
+		{
+			name:    "export folder fails",
+			folders: []map[string]interface{}{{"src": "/srv/app", "dest": "app"}},
+			failing: "mkdir",
+			action:  multistep.ActionHalt,
+		},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		if c.folders != nil {
+			raw["export_config"] = map[string]interface{}{"folders": c.folders}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "output"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		state, driver, ui := testState(t, raw)
+		fakeOutput := driver.SudoFn
+		failing := c.failing
+		driver.SudoFn = func(cmd *HostCmd) error {
+			if cmd.Args[0] == failing {
+				return errors.New("exit status 1")
+			}
+			return fakeOutput(cmd)
+		}
+
+		action := new(stepExport).Run(state)
+		if action != c.action {
+			t.Errorf("%s: action = %v, want %v\n%s", c.name, action, c.action, ui)
+		}
+		if !driver.StopCalled {
+			t.Errorf("%s: container was not stopped", c.name)
+		}
+		if c.want == nil {
+			continue
+		}
+
+		// Only the commands that change something, reading the config
+		// to find the rootfs and fixing up the output are left out
+		var commands [][]string
+		for _, args := range driver.SudoCommands {
+			if args[0] == "tar" || args[0] == "mkdir" || args[0] == "mv" {
+				commands = append(commands, args)
+			}
+		}
+		if want := c.want(dir); !reflect.DeepEqual(commands, want) {
+			t.Errorf("%s: commands = %q, want %q", c.name, commands, want)
+		}
+		for _, name := range []string{"metadata.json", "lxc-config", "rootfs.tar.gz"} {
+			if _, err := os.Stat(filepath.Join(dir, "output", name)); err != nil {
+				t.Errorf("%s: %s", c.name, err)
+			}
+		}
+	}
+}
+
+// testImageDriver is a MockDriver that publishes images, like the LXD driver
+// does.
+type testImageDriver struct {
+	*MockDriver
+	opts       PublishOptions
+	publishErr error
+	deleted    []string
+}
+
+func (d *testImageDriver) Publish(ctx context.Context, name string, opts PublishOptions, w io.Writer) (string, error) {
+	d.opts = opts
+	return "0123456789abcdef", d.publishErr
+}
+
+func (d *testImageDriver) DeleteImage(ctx context.Context, fingerprint string) error {
+	d.deleted = append(d.deleted, fingerprint)
+	return nil
+}
+
+func TestStepExport_publish(t *testing.T) {
+	cases := []struct {
+		name       string
+		alias      string
+		force      bool
+		publishErr error
+		laterErr   error
+		opts       PublishOptions
+		deleted    bool
+	}{
+		{"default alias", "", false, nil, nil, PublishOptions{Alias: "packer-test"}, false},
+		{"image_alias", "base", false, nil, nil, PublishOptions{Alias: "base"}, false},
+		{"force", "", true, nil, nil, PublishOptions{Alias: "packer-test", Replace: true}, false},
+		{"export fails", "", false, errors.New("connection reset"), nil, PublishOptions{Alias: "packer-test"}, true},
+		{"later step fails", "", false, nil, errors.New("post-processor failed"), PublishOptions{Alias: "packer-test"}, true},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		delete(raw, "rootfs")
+		delete(raw, "lxc_path")
+		raw["driver"] = "lxd"
+		raw["lxc_template"] = map[string]interface{}{"name": "images:debian/9"}
+		raw["packer_force"] = c.force
+		if c.alias != "" {
+			raw["export_config"] = map[string]interface{}{"image_alias": c.alias}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "output"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		state, mock, ui := testState(t, raw)
+		mock.setState("packer-test", "RUNNING")
+		driver := &testImageDriver{MockDriver: mock, publishErr: c.publishErr}
+		state.Put("driver", driver)
+
+		step := new(stepExport)
+		action := step.Run(state)
+		if failed := action == multistep.ActionHalt; failed != (c.publishErr != nil) {
+			t.Errorf("%s: action = %v\n%s", c.name, action, ui)
+		}
+		if driver.opts != c.opts {
+			t.Errorf("%s: published with %#v, want %#v", c.name, driver.opts, c.opts)
+		}
+		if c.laterErr != nil {
+			state.Put("error", c.laterErr)
+		}
+
+		step.Cleanup(state)
+		if deleted := len(driver.deleted) == 1 && driver.deleted[0] == "0123456789abcdef"; deleted != c.deleted {
+			t.Errorf("%s: deleted images %q", c.name, driver.deleted)
+		}
+	}
+}
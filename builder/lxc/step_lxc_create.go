@@ -1,12 +1,10 @@
 package lxc
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -14,61 +12,236 @@ import (
 	"github.com/mitchellh/multistep"
 )
 
-type stepLxcCreate struct{}
+type stepLxcCreate struct {
+	logs *logFollower
 
-func (s *stepLxcCreate) createFromTemplate(containerName string, config LxcTemplateConfig) (string, error) {
-	rootfs := filepath.Join(LxcDir, containerName, "rootfs")
+	// created is set once the container belongs to this build. A container
+	// that already existed is left alone by Cleanup.
+	created bool
 
-	commands := make([][]string, 2)
-	commands[0] = append(config.EnvVars, []string{"lxc-create", "-n", containerName, "-t", config.Name, "--"}...)
-	commands[0] = append(commands[0], config.Parameters...)
-	// prevent tmp from being cleaned on boot, we put provisioning scripts there
-	// TODO: wait for init to finish before moving on to provisioning instead of this
-	commands[1] = []string{"touch", filepath.Join(rootfs, "tmp", ".tmpfs")}
+	// diagnose is set while the container is created and started.
+	// stepDiagnostics only runs after this step, so Cleanup collects the
+	// bundle when the step fails in between.
+	diagnose bool
+}
 
-	err := s.SudoCommands(commands...)
-	return rootfs, err
+func (s *stepLxcCreate) createFromTemplate(ctx context.Context, driver Driver, containerName string, config *Config) error {
+	return driver.Create(ctx, containerName, CreateOptions{
+		Template:     config.LxcTemplate,
+		BackingStore: config.BackingStore,
+	})
 }
 
-func (s *stepLxcCreate) createFromRootFs(containerName string, config RootFsConfig) (string, error) {
-	containerPath := filepath.Join(LxcDir, containerName)
+// createFromTemplateCache restores the container from the output of its
+// template in the Packer cache, running the template and caching its output
+// on a cache miss or when a refresh is asked for.
+func (s *stepLxcCreate) createFromTemplateCache(ctx context.Context, driver Driver, cache packer.Cache, config *Config, ui packer.Ui) error {
+	if !config.TemplateCacheRefresh {
+		path, hit, err := restoreTemplate(ctx, driver, cache, config.LxcTemplate, config.LxcPath, config.ContainerName)
+		if hit {
+			ui.Say(fmt.Sprintf("Template cache hit, restored container from %s", path))
+			return err
+		}
+		ui.Say("Template cache miss, creating container from template...")
+	} else {
+		ui.Say("Refreshing template cache, creating container from template...")
+	}
+
+	if err := s.createFromTemplate(ctx, driver, config.ContainerName, config); err != nil {
+		return err
+	}
+
+	path, err := cacheTemplate(ctx, driver, cache, config.LxcTemplate, config.LxcPath, config.ContainerName)
+	if err != nil {
+		return err
+	}
+	ui.Say(fmt.Sprintf("Cached template in %s", path))
+	return nil
+}
+
+func (s *stepLxcCreate) createFromRootFs(ctx context.Context, driver Driver, lxcPath string, containerName string, config RootFsConfig, ui packer.Ui) error {
+	containerPath := filepath.Join(lxcPath, containerName)
 	rootfs := filepath.Join(containerPath, "rootfs")
 	containerConfig, err := NewLxcConfig(config.ConfigFile)
 	if err != nil {
 		err = fmt.Errorf("Could not read lxc config (%s): %s", config.ConfigFile, err)
-		return "", err
+		return err
 	}
 	containerConfig.SetRootFs(rootfs)
 	tmpDir, err := ioutil.TempDir("", "lxcconfig")
 	if err != nil {
 		err = fmt.Errorf("Could not create temp directory for lxc config (%s): %s", tmpDir, err)
-		return rootfs, err
+		return err
 	}
 	defer os.RemoveAll(tmpDir)
 
 	err = containerConfig.Write(filepath.Join(tmpDir, "lxc.config"))
 	if err != nil {
 		err = fmt.Errorf("Could not write lxc config to %s: %s", filepath.Join(tmpDir, "lxc.config"), err)
-		return rootfs, err
+		return err
+	}
+
+	if err := sudo(ctx, driver, "mkdir", containerPath); err != nil {
+		return err
+	}
+	if err := extractArchive(ctx, driver, ui, config.Archive, containerPath); err != nil {
+		return err
+	}
+	return sudo(ctx, driver, "cp", filepath.Join(tmpDir, "lxc.config"), filepath.Join(containerPath, "config"))
+}
+
+// createFromOci creates the container from the layers of an OCI image and
+// the lxc config, with the environment and command of the image added.
+func (s *stepLxcCreate) createFromOci(ctx context.Context, driver Driver, lxcPath string, containerName string, config SourceOciConfig, ui packer.Ui) error {
+	image, err := openOciImage(ctx, config.Path, config.Ref)
+	if err != nil {
+		return fmt.Errorf("Error reading image %s: %s", config.Path, err)
 	}
+	defer image.Close()
 
-	commands := make([][]string, 3)
-	commands[0] = []string{"mkdir", containerPath}
-	commands[1] = []string{"tar", "-C", containerPath, "-xf", config.Archive}
-	commands[2] = []string{"cp", filepath.Join(tmpDir, "lxc.config"), filepath.Join(containerPath, "config")}
+	containerConfig, err := NewLxcConfig(config.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("Could not read lxc config (%s): %s", config.ConfigFile, err)
+	}
+
+	containerPath := filepath.Join(lxcPath, containerName)
+	rootfs := filepath.Join(containerPath, "rootfs")
+	if err := sudoCommands(ctx, driver, []string{"mkdir", containerPath}, []string{"mkdir", rootfs}); err != nil {
+		return err
+	}
 
-	err = s.SudoCommands(commands...)
-	return rootfs, err
+	for i, layer := range image.Layers {
+		ui.Say(fmt.Sprintf("Applying layer %d/%d: %s", i+1, len(image.Layers), filepath.Base(layer.Path)))
+		if err := applyLayer(ctx, driver, rootfs, layer); err != nil {
+			return err
+		}
+	}
+
+	if containerConfig.getProp("lxc.rootfs.path") != "" {
+		containerConfig.setProp("lxc.rootfs.path", rootfs)
+	} else {
+		containerConfig.SetRootFs(rootfs)
+	}
+	if err := setImageConfig(ctx, driver, containerConfig, rootfs, image.Config); err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "lxcconfig")
+	if err != nil {
+		return fmt.Errorf("Could not create temp directory for lxc config (%s): %s", tmpDir, err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := containerConfig.Write(filepath.Join(tmpDir, "lxc.config")); err != nil {
+		return fmt.Errorf("Could not write lxc config to %s: %s", filepath.Join(tmpDir, "lxc.config"), err)
+	}
+	return sudo(ctx, driver, "cp", filepath.Join(tmpDir, "lxc.config"), filepath.Join(containerPath, "config"))
 }
 
-func (s *stepLxcCreate) loadSidedisk(rootfs, archivePath string, destDir string) (error) {
-	destPath := filepath.Join(rootfs, destDir)
+// createFromSource clones the source container. The source has to be
+// stopped, it is never started or changed by the build.
+func (s *stepLxcCreate) createFromSource(ctx context.Context, driver Driver, config *Config) error {
+	source := config.SourceContainer.Name
+	info, err := driver.Info(ctx, source)
+	if err != nil {
+		return fmt.Errorf("Error reading source container %s: %s", source, err)
+	}
+	if info.State != "STOPPED" {
+		return fmt.Errorf("Source container %s must be stopped, state: %s", source, info.State)
+	}
+
+	return driver.Clone(ctx, source, config.ContainerName, CloneOptions{
+		Snapshot:     config.SourceContainer.Snapshot,
+		BackingStore: config.BackingStore,
+	})
+}
+
+// prepareRootfs prepares the rootfs of the created container before it is
+// started and returns where the rootfs is on the host for the communicator.
+// It returns an empty path when the rootfs is only reachable through the
+// running container, like with block backed stores.
+func (s *stepLxcCreate) prepareRootfs(ctx context.Context, driver Driver, config *Config, ui packer.Ui) (string, error) {
+	// prevent tmp from being cleaned on boot, we put provisioning scripts there
+	// TODO: wait for init to finish before moving on to provisioning instead of this
+	if files, ok := driver.(FileDriver); ok {
+		// The rootfs is not on the host
+		return "", files.PushFile(ctx, config.ContainerName, &ContainerFile{
+			Path:    "/tmp/.tmpfs",
+			Mode:    0644,
+			Content: strings.NewReader(""),
+		})
+	}
+
+	// Block backed stores are mounted until the container is started, the
+	// container can't be started while they are mounted on the host.
+	rootfs, err := mountRootfs(ctx, driver, config.LxcPath, config.ContainerName)
+	if err != nil {
+		return "", err
+	}
+	defer rootfs.Unmount(context.Background())
+
+	if config.RootFs == (RootFsConfig{}) && config.SourceOci == (SourceOciConfig{}) {
+		if err := sudo(ctx, driver, "touch", filepath.Join(rootfs.Path, "tmp", ".tmpfs")); err != nil {
+			return "", err
+		}
+	}
+
+	for _, sidedisk := range config.SidediskFolders {
+		if !sidedisk.Persistent() && sidedisk.Type != SidediskBind {
+			if err := s.checkSidediskDest(ctx, driver, rootfs.Path, sidedisk.Dest); err != nil {
+				return "", err
+			}
+		}
+
+		var err error
+		switch sidedisk.Type {
+		case SidediskCopy:
+			ui.Say(fmt.Sprintf("Copying sidedisk \"%s\" to %s", sidedisk.Source, sidedisk.Dest))
+			err = s.copySidedisk(ctx, driver, rootfs.Path, sidedisk.Source, sidedisk.Dest)
+		case SidediskBind:
+			ui.Say(fmt.Sprintf("Mounting sidedisk \"%s\" on %s", sidedisk.Source, sidedisk.Dest))
+			err = s.bindSidedisk(ctx, driver, config, sidedisk)
+		default:
+			ui.Say(fmt.Sprintf("Loading sidedisk \"%s\" to %s", sidedisk.Archive, sidedisk.Dest))
+			err = s.loadSidedisk(ctx, driver, ui, rootfs.Path, sidedisk.Archive, sidedisk.Dest)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
 
-	commands := make([][]string, 2)
-	commands[0] = []string{"mkdir", "-p", destPath}
-	commands[1] = []string{"tar", "-C", destPath, "-xf", archivePath}
+	if !rootfs.mounted {
+		return rootfs.Path, nil
+	}
+	return "", rootfs.Unmount(ctx)
+}
 
-	err := s.SudoCommands(commands...)
+// checkSidediskDest makes sure dest of a sidedisk that doesn't persist isn't
+// in the rootfs yet, the export removes dest with everything below it.
+func (s *stepLxcCreate) checkSidediskDest(ctx context.Context, driver Driver, rootfs string, dest string) error {
+	resolved, err := resolveInRoot(rootfs, dest, func(path string) (string, bool, error) {
+		return hostReadlink(ctx, driver, path)
+	})
+	if err != nil {
+		return fmt.Errorf("Error resolving sidedisk %s: %s", dest, err)
+	}
+	exists, err := hostExists(ctx, driver, resolved)
+	if err != nil {
+		return fmt.Errorf("Error checking sidedisk %s: %s", dest, err)
+	}
+	if exists {
+		return fmt.Errorf("Sidedisk %s doesn't persist, but it already exists in the rootfs and would be removed before the export", dest)
+	}
+	return nil
+}
+
+func (s *stepLxcCreate) loadSidedisk(ctx context.Context, driver Driver, ui packer.Ui, rootfs, archivePath string, destDir string) error {
+	destPath := filepath.Join(rootfs, destDir)
+
+	err := sudo(ctx, driver, "mkdir", "-p", destPath)
+	if err == nil {
+		err = extractArchive(ctx, driver, ui, archivePath, destPath)
+	}
 	if err != nil {
 		err = fmt.Errorf("Could not load sidedisk: %s", err)
 		return err
@@ -76,95 +249,200 @@ func (s *stepLxcCreate) loadSidedisk(rootfs, archivePath string, destDir string)
 	return nil
 }
 
+func (s *stepLxcCreate) copySidedisk(ctx context.Context, driver Driver, rootfs string, source string, destDir string) error {
+	destPath := filepath.Join(rootfs, destDir)
+
+	err := sudoCommands(ctx, driver,
+		[]string{"mkdir", "-p", destPath},
+		[]string{"cp", "-a", strings.TrimRight(source, "/") + "/.", destPath},
+	)
+	if err != nil {
+		return fmt.Errorf("Could not copy sidedisk: %s", err)
+	}
+	return nil
+}
+
+// bindSidedisk adds a bind mount of the sidedisk to the container config, it
+// is mounted when the container starts and gone once it stops.
+func (s *stepLxcCreate) bindSidedisk(ctx context.Context, driver Driver, config *Config, sidedisk SidediskFolder) error {
+	options := "bind,create=dir"
+	if sidedisk.ReadOnly {
+		options += ",ro"
+	}
+	// The mount point is relative to the rootfs, spaces are escaped like in fstab
+	escape := strings.NewReplacer(" ", "\\040", "\t", "\\011")
+	entry := fmt.Sprintf("\nlxc.mount.entry = %s %s none %s 0 0\n",
+		escape.Replace(sidedisk.Source), escape.Replace(strings.TrimLeft(sidedisk.Dest, "/")), options)
+
+	err := driver.SudoCommand(ctx, &HostCmd{
+		Args:   []string{"tee", "-a", filepath.Join(config.LxcPath, config.ContainerName, "config")},
+		Stdin:  strings.NewReader(entry),
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not mount sidedisk: %s", err)
+	}
+	return nil
+}
+
 func (s *stepLxcCreate) Run(state multistep.StateBag) multistep.StepAction {
+	ctx := state.Get("context").(context.Context)
 	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	errorHandler := func(err error) {
 		state.Put("error", err)
 		ui.Error(err.Error())
 	}
 
-	if config.PackerForce {
-		s.destroy(config.ContainerName, ui)
+	if _, ok := driver.(FileDriver); !ok {
+		// The lxc path is written by root, which may not be this user
+		if err := sudo(ctx, driver, "test", "-w", config.LxcPath); err != nil {
+			errorHandler(fmt.Errorf("lxc_path %s is not writable: %s", config.LxcPath, err))
+			return multistep.ActionHalt
+		}
+	}
+
+	if _, err := driver.Info(ctx, config.ContainerName); err == nil {
+		if !config.PackerForce {
+			errorHandler(fmt.Errorf("Container %s already exists, use -force to replace it", config.ContainerName))
+			return multistep.ActionHalt
+		}
+		s.destroy(ctx, driver, config.ContainerName, ui)
 	}
 
-	var rootfs string
+	// A failed create may leave parts of the container behind, they are
+	// cleaned up as well
+	s.created = true
+	s.diagnose = true
+	state.Put("container_created", true)
+
 	var err error
-	if config.LxcTemplate.Name != "" {
+	if config.SourceContainer.Name != "" {
+		ui.Say(fmt.Sprintf("Cloning container from %s...", config.SourceContainer.Name))
+		err = s.createFromSource(ctx, driver, config)
+	} else if config.SourceOci != (SourceOciConfig{}) {
+		ui.Say(fmt.Sprintf("Creating container from image: %s", config.SourceOci.Path))
+		err = s.createFromOci(ctx, driver, config.LxcPath, config.ContainerName, config.SourceOci, ui)
+	} else if config.LxcTemplate.Name != "" && config.TemplateCache {
+		err = s.createFromTemplateCache(ctx, driver, state.Get("cache").(packer.Cache), config, ui)
+	} else if config.LxcTemplate.Name != "" {
 		ui.Say("Creating container from template...")
-		rootfs, err = s.createFromTemplate(config.ContainerName, config.LxcTemplate)
+		err = s.createFromTemplate(ctx, driver, config.ContainerName, config)
 	} else {
-		ui.Say(fmt.Sprintf("Creating container from archive: %s", config.RootFs.Archive))
-		rootfs, err = s.createFromRootFs(config.ContainerName, config.RootFs)
+		rootfs := config.RootFs
+		if path, ok := state.GetOk("rootfs_archive"); ok {
+			// Downloaded and verified by common.StepDownload
+			rootfs.Archive = path.(string)
+		}
+		ui.Say(fmt.Sprintf("Creating container from archive: %s", rootfs.Archive))
+		err = s.createFromRootFs(ctx, driver, config.LxcPath, config.ContainerName, rootfs, ui)
 	}
 	if err != nil {
 		errorHandler(err)
 		return multistep.ActionHalt
 	}
 
-	for _, sidedisk := range config.SidediskFolders {
-		ui.Say(fmt.Sprintf("Loading sidedisk \"%s\" to %s", sidedisk.Archive, sidedisk.Dest))
-		err = s.loadSidedisk(rootfs, sidedisk.Archive, sidedisk.Dest)
+	rootfs, err := s.prepareRootfs(ctx, driver, config, ui)
+	if err != nil {
+		errorHandler(err)
+		return multistep.ActionHalt
+	}
+
+	// A FileDriver keeps the logs of its containers itself
+	var startOpts StartOptions
+	_, fileDriver := driver.(FileDriver)
+	if !fileDriver {
+		logsDir, err := logDir(config)
+		if err == nil {
+			err = os.MkdirAll(logsDir, 0755)
+		}
 		if err != nil {
-			errorHandler(err)
+			errorHandler(fmt.Errorf("Error creating log directory: %s", err))
 			return multistep.ActionHalt
 		}
+		startOpts = StartOptions{
+			LogFile:     filepath.Join(logsDir, "lxc-start.log"),
+			LogPriority: "INFO",
+			ConsoleLog:  filepath.Join(logsDir, "console.log"),
+		}
+		state.Put("lxc_log", startOpts.LogFile)
+		state.Put("console_log", startOpts.ConsoleLog)
 	}
 
 	ui.Say("Starting container...")
-	if err = s.SudoCommand("lxc-start", "-d", "-n", config.ContainerName); err != nil {
+	if err := driver.Start(ctx, config.ContainerName, startOpts); err != nil {
 		errorHandler(fmt.Errorf("Error starting container: %s", err))
 		return multistep.ActionHalt
 	}
 
+	if !fileDriver {
+		s.logs = followLogs(ctx, driver, startOpts.LogFile, startOpts.ConsoleLog)
+	}
+	s.diagnose = false
+
 	state.Put("mount_path", rootfs)
 	return multistep.ActionContinue
 }
 
 func (s *stepLxcCreate) Cleanup(state multistep.StateBag) {
-	config := state.Get("config").(*Config)
-	s.destroy(config.ContainerName, state.Get("ui").(packer.Ui))
-}
-
-func (s *stepLxcCreate) destroy(name string, ui packer.Ui) {
-	command := []string{
-		"lxc-destroy", "-f", "-n", name,
+	if !s.created {
+		return
 	}
 
-	ui.Say("Unregistering and deleting virtual machine...")
-	if err := s.SudoCommand(command...); err != nil {
-		ui.Error(fmt.Sprintf("Error deleting virtual machine: %s", err))
-	}
-}
+	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
 
-func (s *stepLxcCreate) SudoCommand(args ...string) error {
-	var stdout, stderr bytes.Buffer
+	_, failed := state.GetOk("error")
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
 
-	log.Printf("Executing sudo command: %#v", args)
-	cmd := exec.Command("sudo", args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	if s.diagnose {
+		new(stepDiagnostics).Cleanup(state)
+	}
 
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
+	if config.KeepContainer == KeepContainerAlways ||
+		(config.KeepContainer == KeepContainerOnError && (failed || cancelled || halted)) {
+		ui.Say(fmt.Sprintf("Keeping container %s...", config.ContainerName))
+		state.Put("container_kept", true)
+	} else {
+		state.Put("container_kept", false)
+		// The build context may already be cancelled, the container has to be
+		// destroyed regardless.
+		s.destroy(context.Background(), driver, config.ContainerName, ui)
+	}
 
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("Sudo command (%s) failed with error: %s", args, stderrString)
+	if s.logs != nil {
+		s.logs.Stop()
+		s.logs = nil
 	}
 
-	log.Printf("stdout: %s", stdoutString)
-	log.Printf("stderr: %s", stderrString)
+	if _, ok := driver.(FileDriver); ok {
+		return
+	}
+	logsDir, err := logDir(config)
+	if err != nil {
+		return
+	}
+	if failed || cancelled || halted || config.KeepLogs {
+		if err := reclaimLogs(driver, logsDir); err != nil {
+			ui.Error(fmt.Sprintf("Error changing owner of container logs: %s", err))
+		}
+		if failed || cancelled || halted {
+			ui.Say(fmt.Sprintf("Container logs kept in: %s", logsDir))
+		}
+		return
+	}
 
-	return err
+	if err := sudo(context.Background(), driver, "rm", "-rf", logsDir); err != nil {
+		ui.Error(fmt.Sprintf("Error removing container logs: %s", err))
+	}
 }
 
-func (s *stepLxcCreate) SudoCommands(commands ...[]string) error {
-	for _, command := range commands {
-		log.Printf("Executing sudo command: %#v", command)
-		if err := s.SudoCommand(command...); err != nil {
-			return err
-		}
+func (s *stepLxcCreate) destroy(ctx context.Context, driver Driver, name string, ui packer.Ui) {
+	ui.Say("Unregistering and deleting virtual machine...")
+	if err := driver.Destroy(ctx, name); err != nil {
+		ui.Error(fmt.Sprintf("Error deleting virtual machine: %s", err))
 	}
-	return nil
 }
@@ -0,0 +1,171 @@
+package lxc
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepLxcCreate(t *testing.T) {
+	cases := []struct {
+		name     string
+		exists   bool
+		force    bool
+		startErr error
+		action   multistep.StepAction
+		created  bool
+		destroys int
+	}{
+		{"new", false, false, nil, multistep.ActionContinue, true, 1},
+		{"exists", true, false, nil, multistep.ActionHalt, false, 0},
+		{"force", true, true, nil, multistep.ActionContinue, true, 2},
+		{"start fails", false, false, errors.New("no init"), multistep.ActionHalt, true, 1},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		raw["packer_force"] = c.force
+
+		state, driver, ui := testState(t, raw)
+		if c.exists {
+			driver.setState("packer-test", "STOPPED")
+		}
+		driver.StartErr = c.startErr
+
+		step := new(stepLxcCreate)
+		action := step.Run(state)
+		if action != c.action {
+			t.Errorf("%s: action = %v, want %v\n%s", c.name, action, c.action, ui)
+		}
+		if created := strings.Contains(ui.String(), "Creating container"); created != c.created {
+			t.Errorf("%s: created = %t, want %t", c.name, created, c.created)
+		}
+		if action == multistep.ActionHalt {
+			state.Put(multistep.StateHalted, true)
+		}
+
+		// Count the destroys on the way, the mock only remembers the last one
+		destroys := 0
+		if driver.DestroyCalled {
+			destroys++
+			driver.DestroyCalled = false
+		}
+		step.Cleanup(state)
+		if driver.DestroyCalled {
+			destroys++
+		}
+		if destroys != c.destroys {
+			t.Errorf("%s: %d destroys, want %d", c.name, destroys, c.destroys)
+		}
+		if c.exists && !c.force {
+			if _, ok := driver.Containers["packer-test"]; !ok {
+				t.Errorf("%s: existing container was destroyed", c.name)
+			}
+		}
+
+		// A failed start is diagnosed right away, the diagnostics step
+		// hasn't run yet
+		_, err := os.Stat(raw["diagnostics_directory"].(string))
+		if diagnosed := err == nil; diagnosed != (c.startErr != nil) {
+			t.Errorf("%s: diagnostics collected = %t", c.name, diagnosed)
+		}
+	}
+}
+
+func TestStepLxcCreate_keepContainer(t *testing.T) {
+	cases := []struct {
+		keep   string
+		failed bool
+		kept   bool
+	}{
+		{KeepContainerNever, false, false},
+		{KeepContainerNever, true, false},
+		{KeepContainerOnError, false, false},
+		{KeepContainerOnError, true, true},
+		{KeepContainerAlways, false, true},
+		{KeepContainerAlways, true, true},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		raw["keep_container"] = c.keep
+
+		state, driver, ui := testState(t, raw)
+		step := new(stepLxcCreate)
+		if action := step.Run(state); action != multistep.ActionContinue {
+			t.Fatalf("%s: Run halted:\n%s", c.keep, ui)
+		}
+		if c.failed {
+			state.Put("error", errors.New("provisioning failed"))
+		}
+		step.Cleanup(state)
+
+		if driver.DestroyCalled == c.kept {
+			t.Errorf("%s, failed %t: destroyed = %t", c.keep, c.failed, driver.DestroyCalled)
+		}
+		if kept := state.Get("container_kept"); kept != c.kept {
+			t.Errorf("%s, failed %t: container_kept = %v, want %t", c.keep, c.failed, kept, c.kept)
+		}
+	}
+}
+
+func TestStepLxcCreate_sourceContainer(t *testing.T) {
+	cases := []struct {
+		name     string
+		source   string
+		snapshot bool
+		action   multistep.StepAction
+	}{
+		{"stopped", "STOPPED", false, multistep.ActionContinue},
+		{"snapshot", "STOPPED", true, multistep.ActionContinue},
+		{"running", "RUNNING", false, multistep.ActionHalt},
+		{"missing", "", false, multistep.ActionHalt},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		delete(raw, "rootfs")
+		raw["source_container"] = map[string]interface{}{"name": "base", "snapshot": c.snapshot}
+
+		state, driver, ui := testState(t, raw)
+		if c.source != "" {
+			driver.setState("base", c.source)
+		}
+
+		step := new(stepLxcCreate)
+		action := step.Run(state)
+		if action != c.action {
+			t.Errorf("%s: action = %v, want %v\n%s", c.name, action, c.action, ui)
+		}
+		if cloned := action == multistep.ActionContinue; driver.CloneCalled != cloned {
+			t.Errorf("%s: cloned = %t, want %t", c.name, driver.CloneCalled, cloned)
+		} else if cloned {
+			if driver.CloneSource != "base" || driver.CloneName != "packer-test" || driver.CloneOptions.Snapshot != c.snapshot {
+				t.Errorf("%s: cloned %s to %s with %#v", c.name, driver.CloneSource, driver.CloneName, driver.CloneOptions)
+			}
+		}
+		if driver.CreateCalled {
+			t.Errorf("%s: container created from a template", c.name)
+		}
+		if action == multistep.ActionHalt {
+			state.Put(multistep.StateHalted, true)
+		}
+
+		// The source is never started or destroyed
+		step.Cleanup(state)
+		if c.source != "" {
+			if info, ok := driver.Containers["base"]; !ok || info.State != c.source {
+				t.Errorf("%s: source container changed: %#v", c.name, info)
+			}
+		}
+		if driver.StartName == "base" || driver.DestroyName == "base" {
+			t.Errorf("%s: source container was started or destroyed", c.name)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package lxc
 
 import (
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/hashicorp/packer/packer"
@@ -36,6 +38,21 @@ func (stepPrepareOutputDir) Cleanup(state multistep.StateBag) {
 		config := state.Get("config").(*Config)
 		ui := state.Get("ui").(packer.Ui)
 
+		// The container logs are kept to debug the failed build
+		if logs, _ := ioutil.ReadDir(filepath.Join(config.OutputDir, logDirName)); len(logs) > 0 {
+			ui.Say("Deleting output directory, except for the container logs...")
+			entries, _ := ioutil.ReadDir(config.OutputDir)
+			for _, entry := range entries {
+				if entry.Name() == logDirName {
+					continue
+				}
+				if err := os.RemoveAll(filepath.Join(config.OutputDir, entry.Name())); err != nil {
+					log.Printf("Error removing output dir content: %s", err)
+				}
+			}
+			return
+		}
+
 		ui.Say("Deleting output directory...")
 		for i := 0; i < 5; i++ {
 			err := os.RemoveAll(config.OutputDir)
@@ -1,32 +1,71 @@
 package lxc
 
 import (
-	"github.com/mitchellh/multistep"
+	"context"
+	"fmt"
 	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
 	"log"
 )
 
 // StepProvision provisions the instance within a chroot.
-type StepProvision struct {}
+type StepProvision struct{}
 
 func (s *StepProvision) Run(state multistep.StateBag) multistep.StepAction {
+	ctx := state.Get("context").(context.Context)
 	hook := state.Get("hook").(packer.Hook)
 	config := state.Get("config").(*Config)
 	mountPath := state.Get("mount_path").(string)
 	ui := state.Get("ui").(packer.Ui)
-	wrappedCommand := state.Get("wrappedCommand").(CommandWrapper)
+	driver := state.Get("driver").(Driver)
+
+	// Abort provisioning as soon as the container stops
+	watcher := watchContainer(ctx, driver, config.ContainerName)
+	defer watcher.Stop()
 
 	// Create our communicator
 	comm := &LxcAttachCommunicator{
 		ContainerName: config.ContainerName,
 		RootFs:        mountPath,
-		CmdWrapper:    wrappedCommand,
+		Driver:        driver,
+		Attach:        config.AttachConfig,
+		Ctx:           watcher.Context(),
+		Ui:            ui,
 	}
 
+	// Remember the failing command for the diagnostics bundle
+	defer func() {
+		if lastCommand := comm.LastCommand(); lastCommand != "" {
+			state.Put("last_command", lastCommand)
+		}
+	}()
+
 	// Provision
 	log.Println("Running the provision hook")
+	provisionDone := make(chan struct{})
+	defer close(provisionDone)
+	go func() {
+		select {
+		case <-watcher.Stopped():
+			log.Println("Container stopped, cancelling the provision hook")
+			hook.Cancel()
+		case <-provisionDone:
+		}
+	}()
+
 	if err := hook.Run(packer.HookProvision, ui, comm, nil); err != nil {
+		if stopErr := watcher.Err(); stopErr != nil {
+			err = fmt.Errorf("Error provisioning container: %s", stopErr)
+			ui.Error(err.Error())
+		}
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	if err := watcher.Err(); err != nil {
+		err = fmt.Errorf("Error provisioning container: %s", err)
 		state.Put("error", err)
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
@@ -0,0 +1,50 @@
+package lxc
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepProvision(t *testing.T) {
+	cases := []struct {
+		name    string
+		hookErr error
+		action  multistep.StepAction
+	}{
+		{"success", nil, multistep.ActionContinue},
+		{"provisioner fails", errors.New("script exited with 1"), multistep.ActionHalt},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		raw["attach_env"] = []string{"FOO=bar"}
+
+		state, driver, _ := testState(t, raw)
+		state.Put("mount_path", dir)
+		driver.setState("packer-test", "RUNNING")
+		hookErr := c.hookErr
+		hook := &packer.MockHook{RunFunc: func() error { return hookErr }}
+		state.Put("hook", hook)
+
+		action := new(StepProvision).Run(state)
+		if action != c.action {
+			t.Errorf("%s: action = %v, want %v", c.name, action, c.action)
+		}
+		if !hook.RunCalled || hook.RunName != packer.HookProvision {
+			t.Fatalf("%s: provision hook was not run", c.name)
+		}
+
+		comm, ok := hook.RunComm.(*LxcAttachCommunicator)
+		if !ok || comm.ContainerName != "packer-test" || comm.RootFs != dir || len(comm.Attach.AttachEnv) != 1 {
+			t.Errorf("%s: unexpected communicator: %#v", c.name, hook.RunComm)
+		}
+		if rawErr, failed := state.GetOk("error"); failed != (c.hookErr != nil) || (failed && rawErr != c.hookErr) {
+			t.Errorf("%s: error = %v, want %v", c.name, rawErr, c.hookErr)
+		}
+	}
+}
@@ -1,29 +1,38 @@
 package lxc
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/mitchellh/multistep"
 	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
 	"log"
-	"strings"
 	"time"
 )
 
 type StepWaitInit struct {
-	WaitTimeout time.Duration
+	WaitTimeout    time.Duration
+	NetworkTimeout time.Duration
 }
 
 func (s *StepWaitInit) Run(state multistep.StateBag) multistep.StepAction {
+	ctx := state.Get("context").(context.Context)
+	config := state.Get("config").(*Config)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
+	// Give up right away instead of waiting for the timeout if the
+	// container dies while booting.
+	watcher := watchContainer(ctx, driver, config.ContainerName)
+	defer watcher.Stop()
+
 	var err error
 
 	cancel := make(chan struct{})
 	waitDone := make(chan bool, 1)
 	go func() {
 		ui.Say("Waiting for container to finish init...")
-		err = s.waitForInit(state, cancel)
+		err = s.waitForInit(state, watcher.Context(), cancel)
 		waitDone <- true
 	}()
 
@@ -33,18 +42,31 @@ WaitLoop:
 	for {
 		select {
 		case <-waitDone:
+			if stopErr := watcher.Err(); stopErr != nil {
+				err = stopErr
+			}
 			if err != nil {
-				ui.Error(fmt.Sprintf("Error waiting for container to finish init: %s", err))
+				err := fmt.Errorf("Error waiting for container to finish init: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
 				return multistep.ActionHalt
 			}
 
 			ui.Say("Container finished init!")
 			break WaitLoop
+		case <-watcher.Stopped():
+			err := fmt.Errorf("Error waiting for container to finish init: %s", watcher.Err())
+			state.Put("error", err)
+			ui.Error(err.Error())
+			close(cancel)
+			s.showConsoleLog(state)
+			return multistep.ActionHalt
 		case <-timeout:
 			err := fmt.Errorf("Timeout waiting for container to finish init.")
 			state.Put("error", err)
 			ui.Error(err.Error())
 			close(cancel)
+			s.showConsoleLog(state)
 			return multistep.ActionHalt
 		case <-time.After(1 * time.Second):
 			if _, ok := state.GetOk(multistep.StateCancelled); ok {
@@ -55,41 +77,96 @@ WaitLoop:
 		}
 	}
 
+	if !config.NetworkWaitIPv4 && !config.NetworkWaitIPv6 {
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Waiting for container network...")
+	log.Printf("Waiting for container network, up to timeout: %s", s.NetworkTimeout)
+	ipv4, ipv6, err := s.waitForNetwork(state, watcher.Context())
+	if stopErr := watcher.Err(); stopErr != nil {
+		err = stopErr
+	}
+	if err != nil {
+		err := fmt.Errorf("Error waiting for container network: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ip := ipv4
+	if ip == "" {
+		ip = ipv6
+	}
+	ui.Say(fmt.Sprintf("Container network is up: %s", ip))
+	state.Put("container_ip", ip)
+	state.Put("container_ipv4", ipv4)
+	state.Put("container_ipv6", ipv6)
+
 	return multistep.ActionContinue
 }
 
 func (s *StepWaitInit) Cleanup(multistep.StateBag) {
 }
 
-func (s *StepWaitInit) waitForInit(state multistep.StateBag, cancel <-chan struct{}) error {
+// showConsoleLog shows the last lines of the container console, which
+// usually tell why init didn't finish.
+func (s *StepWaitInit) showConsoleLog(state multistep.StateBag) {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	consoleLog, ok := state.GetOk("console_log")
+	if !ok {
+		return
+	}
+
+	lines, err := tailLog(driver, consoleLog.(string), 20)
+	if err != nil {
+		log.Printf("Error reading console log: %s", err)
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	ui.Message("Last lines of the container console:")
+	for _, line := range lines {
+		ui.Message(line)
+	}
+}
+
+func (s *StepWaitInit) waitForInit(state multistep.StateBag, ctx context.Context, cancel <-chan struct{}) error {
 	config := state.Get("config").(*Config)
 	mountPath := state.Get("mount_path").(string)
-	wrappedCommand := state.Get("wrappedCommand").(CommandWrapper)
+	driver := state.Get("driver").(Driver)
+
+	comm := &LxcAttachCommunicator{
+		ContainerName: config.ContainerName,
+		RootFs:        mountPath,
+		Driver:        driver,
+		Ctx:           ctx,
+	}
+
+	strategy, err := newWaitStrategy(config, comm)
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case <-cancel:
 			log.Println("Cancelled. Exiting loop.")
 			return errors.New("Wait cancelled")
+		case <-ctx.Done():
+			log.Println("Build cancelled. Exiting loop.")
+			return errors.New("Wait cancelled")
 		case <-time.After(1 * time.Second):
 		}
 
-		comm := &LxcAttachCommunicator{
-			ContainerName: config.ContainerName,
-			RootFs:        mountPath,
-			CmdWrapper:    wrappedCommand,
-		}
-
-		runlevel, _ := comm.CheckInit()
-		currentRunlevel := "unknown"
-		if arr := strings.Split(runlevel, " "); len(arr) >= 2 {
-			currentRunlevel = arr[1]
+		ready, err := strategy.Ready(comm)
+		if err != nil {
+			log.Printf("Error checking whether container finished init: %s", err)
 		}
-
-		log.Printf("Current runlevel in container: '%s'", runlevel)
-
-		targetRunlevel := fmt.Sprintf("%d", config.TargetRunlevel)
-		if currentRunlevel == targetRunlevel {
+		if ready {
 			log.Printf("Container finished init.")
 			break
 		}
@@ -97,3 +174,49 @@ func (s *StepWaitInit) waitForInit(state multistep.StateBag, cancel <-chan struc
 
 	return nil
 }
+
+// waitForNetwork polls the addresses of the container until it has the
+// requested IPv4 and/or IPv6 address, returning the first one of each.
+func (s *StepWaitInit) waitForNetwork(state multistep.StateBag, ctx context.Context) (string, string, error) {
+	config := state.Get("config").(*Config)
+	mountPath := state.Get("mount_path").(string)
+	driver := state.Get("driver").(Driver)
+
+	comm := &LxcAttachCommunicator{
+		ContainerName: config.ContainerName,
+		RootFs:        mountPath,
+		Driver:        driver,
+		Ctx:           ctx,
+	}
+
+	timeout := time.After(s.NetworkTimeout)
+	for {
+		ipv4, ipv6, err := comm.IPAddresses(config.NetworkInterface)
+		if err != nil {
+			log.Printf("Error reading container addresses: %s", err)
+		}
+
+		log.Printf("Current container addresses: ipv4 %v, ipv6 %v", ipv4, ipv6)
+		if (len(ipv4) > 0 || !config.NetworkWaitIPv4) && (len(ipv6) > 0 || !config.NetworkWaitIPv6) {
+			var ip4, ip6 string
+			if len(ipv4) > 0 {
+				ip4 = ipv4[0]
+			}
+			if len(ipv6) > 0 {
+				ip6 = ipv6[0]
+			}
+			return ip4, ip6, nil
+		}
+
+		select {
+		case <-timeout:
+			return "", "", errors.New("Timeout waiting for container network.")
+		case <-ctx.Done():
+			return "", "", errors.New("Wait cancelled")
+		case <-time.After(1 * time.Second):
+			if _, ok := state.GetOk(multistep.StateCancelled); ok {
+				return "", "", errors.New("Wait cancelled")
+			}
+		}
+	}
+}
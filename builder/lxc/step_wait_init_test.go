@@ -0,0 +1,60 @@
+package lxc
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepWaitInit(t *testing.T) {
+	cases := []struct {
+		name     string
+		state    string
+		runlevel string
+		ips      []string
+		network  bool
+		err      string
+		ip       string
+	}{
+		{"ready", "RUNNING", "N 3", nil, false, "", ""},
+		{"network", "RUNNING", "N 3", []string{"127.0.0.1", "fe80::1", "10.0.3.2"}, true, "", "10.0.3.2"},
+		{"stopped", "STOPPED", "N 3", nil, false, "Container stopped unexpectedly", ""},
+		{"timeout", "RUNNING", "N 2", nil, false, "Timeout waiting for container to finish init", ""},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		raw["wait_strategy"] = "runlevel"
+		raw["network_wait_ipv4"] = c.network
+
+		state, driver, ui := testState(t, raw)
+		state.Put("mount_path", "")
+		driver.setState("packer-test", c.state)
+		driver.Containers["packer-test"].IPs = c.ips
+		runlevel := c.runlevel
+		driver.AttachFn = func(name string, cmd *AttachCmd) (int, error) {
+			io.WriteString(cmd.Stdout, runlevel+"\n")
+			return 0, nil
+		}
+
+		step := &StepWaitInit{WaitTimeout: 5 * time.Second, NetworkTimeout: 5 * time.Second}
+		action := step.Run(state)
+		rawErr, failed := state.GetOk("error")
+		if c.err == "" {
+			if action != multistep.ActionContinue || failed {
+				t.Errorf("%s: action = %v, error = %v\n%s", c.name, action, rawErr, ui)
+			}
+		} else if action != multistep.ActionHalt || !failed || !strings.Contains(rawErr.(error).Error(), c.err) {
+			t.Errorf("%s: action = %v, error = %v, want %q", c.name, action, rawErr, c.err)
+		}
+
+		if ip, _ := state.GetOk("container_ip"); c.ip != "" && ip != c.ip {
+			t.Errorf("%s: container_ip = %v, want %s", c.name, ip, c.ip)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+var (
+	utsNameProp = regexp.MustCompile(`(?m)^(\s*lxc\.(?:utsname|uts\.name)\s*=\s*).*$`)
+	hwaddrProp  = regexp.MustCompile(`(?m)^(\s*lxc\.(?:network|net\.\d+)\.hwaddr\s*=\s*).*$`)
+)
+
+// templateCacheKey returns the key of the rootfs created by a template in
+// the Packer cache. Everything that goes into the template is part of it.
+func templateCacheKey(template LxcTemplateConfig) string {
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode(template)
+	return fmt.Sprintf("lxc-template-%x.tar.gz", hash.Sum(nil))
+}
+
+// restoreTemplate creates a container from the cached output of its
+// template. It returns false if the template isn't cached.
+func restoreTemplate(ctx context.Context, driver Driver, cache packer.Cache, template LxcTemplateConfig, lxcPath string, name string) (string, bool, error) {
+	key := templateCacheKey(template)
+	path, ok := cache.RLock(key)
+	defer cache.RUnlock(key)
+	if !ok {
+		return path, false, nil
+	}
+
+	containerDir := filepath.Join(lxcPath, name)
+	log.Printf("Restoring container %s from template cache %s", name, path)
+	err := sudoCommands(ctx, driver,
+		[]string{"mkdir", containerDir},
+		[]string{"tar", "-C", containerDir, "--numeric-owner", "-xpzf", path},
+	)
+	if err == nil {
+		err = renameContainerConfig(ctx, driver, lxcPath, name)
+	}
+	if err != nil {
+		return path, true, fmt.Errorf("Error restoring template from cache: %s", err)
+	}
+	return path, true, nil
+}
+
+// cacheTemplate stores the container a template just created in the cache.
+func cacheTemplate(ctx context.Context, driver Driver, cache packer.Cache, template LxcTemplateConfig, lxcPath string, name string) (string, error) {
+	key := templateCacheKey(template)
+	path := cache.Lock(key)
+	defer cache.Unlock(key)
+
+	log.Printf("Caching template of container %s in %s", name, path)
+	err := sudoCommands(ctx, driver,
+		[]string{"tar", "-C", filepath.Join(lxcPath, name), "--numeric-owner", "-czf", path, "."},
+		[]string{"chown", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), path},
+	)
+	if err != nil {
+		// A partial archive must not be restored by the next build
+		sudo(context.Background(), driver, "rm", "-f", path)
+		return path, fmt.Errorf("Error caching template: %s", err)
+	}
+	return path, nil
+}
+
+// renameContainerConfig points the config of a container restored from the
+// cache to its own directory and name, and gives it new MAC addresses.
+func renameContainerConfig(ctx context.Context, driver Driver, lxcPath string, name string) error {
+	configPath := filepath.Join(lxcPath, name, "config")
+
+	var stdout bytes.Buffer
+	err := driver.SudoCommand(ctx, &HostCmd{Args: []string{"cat", configPath}, Stdout: &stdout})
+	if err != nil {
+		return err
+	}
+	content := stdout.String()
+
+	// Paths in the config are below the directory of the cached container
+	config := &lxcConfig{lines: strings.Split(content, "\n")}
+	for _, key := range []string{"lxc.rootfs.path", "lxc.rootfs"} {
+		spec := config.getProp(key)
+		if spec == "" {
+			continue
+		}
+		if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+			spec = parts[1]
+		}
+		oldDir := filepath.Dir(spec)
+		content = strings.Replace(content, oldDir+"/", filepath.Join(lxcPath, name)+"/", -1)
+		break
+	}
+
+	content = utsNameProp.ReplaceAllString(content, "${1}"+name)
+	content = hwaddrProp.ReplaceAllStringFunc(content, func(line string) string {
+		return hwaddrProp.ReplaceAllString(line, "${1}"+randomHwaddr())
+	})
+
+	return driver.SudoCommand(ctx, &HostCmd{
+		Args:   []string{"tee", configPath},
+		Stdin:  strings.NewReader(content),
+		Stdout: &bytes.Buffer{},
+	})
+}
+
+// randomHwaddr returns a random MAC address in the range LXC uses.
+func randomHwaddr() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("00:16:3e:%02x:%02x:%02x", b[0], b[1], b[2])
+}
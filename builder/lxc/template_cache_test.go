@@ -0,0 +1,137 @@
+package lxc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepLxcCreate_templateCache(t *testing.T) {
+	cacheDir := testDir(t)
+	defer os.RemoveAll(cacheDir)
+	cache := &packer.FileCache{CacheDir: cacheDir}
+
+	// The first build misses and fills the cache, the second restores the
+	// container from it and the refresh runs the template again.
+	cases := []struct {
+		name    string
+		refresh bool
+		created bool
+		say     string
+	}{
+		{"miss", false, true, "Template cache miss"},
+		{"hit", false, false, "Template cache hit"},
+		{"refresh", true, true, "Refreshing template cache"},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		raw := testConfig(t, dir)
+		delete(raw, "rootfs")
+		raw["lxc_template"] = map[string]interface{}{"name": "debian", "parameters": []string{"-r", "stretch"}}
+		raw["template_cache"] = true
+		raw["template_cache_refresh"] = c.refresh
+
+		state, driver, ui := testState(t, raw)
+		state.Put("cache", cache)
+		step := new(stepLxcCreate)
+		if action := step.Run(state); action != multistep.ActionContinue {
+			t.Fatalf("%s: Run halted:\n%s", c.name, ui)
+		}
+		// Stops following the container logs, which runs commands too
+		step.Cleanup(state)
+
+		if !strings.Contains(ui.String(), c.say) {
+			t.Errorf("%s: expected %q:\n%s", c.name, c.say, ui)
+		}
+		if driver.CreateCalled != c.created {
+			t.Errorf("%s: template run = %t, want %t", c.name, driver.CreateCalled, c.created)
+		}
+		var restored, cached bool
+		for _, args := range driver.SudoCommands {
+			if args[0] == "tar" {
+				restored = restored || args[len(args)-2] == "-xpzf"
+				cached = cached || args[len(args)-3] == "-czf"
+			}
+		}
+		if restored == c.created || cached != c.created {
+			t.Errorf("%s: restored = %t, cached = %t:\n%q", c.name, restored, cached, driver.SudoCommands)
+		}
+	}
+
+	files, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("%d files in the cache, want the one archive of the template", len(files))
+	}
+}
+
+func TestTemplateCacheKey(t *testing.T) {
+	template := LxcTemplateConfig{Name: "debian", Parameters: []string{"-r", "stretch"}}
+	key := templateCacheKey(template)
+	if key != templateCacheKey(template) {
+		t.Errorf("key of the same template changed")
+	}
+	for _, other := range []LxcTemplateConfig{
+		{Name: "ubuntu", Parameters: []string{"-r", "stretch"}},
+		{Name: "debian", Parameters: []string{"-r", "buster"}},
+		{Name: "debian", Parameters: []string{"-r", "stretch"}, EnvVars: []string{"MIRROR=http://mirror"}},
+	} {
+		if templateCacheKey(other) == key {
+			t.Errorf("%#v has the key of %#v", other, template)
+		}
+	}
+}
+
+func TestRenameContainerConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			"lxc 3",
+			"lxc.rootfs.path = dir:/var/lib/lxc/cached/rootfs\nlxc.mount.fstab = /var/lib/lxc/cached/fstab\nlxc.uts.name = cached\nlxc.net.0.hwaddr = 00:16:3e:00:00:01\n",
+			"lxc.rootfs.path = dir:/srv/lxc/packer/rootfs\nlxc.mount.fstab = /srv/lxc/packer/fstab\nlxc.uts.name = packer\nlxc.net.0.hwaddr = 00:16:3e:",
+		},
+		{
+			"lxc 2",
+			"lxc.rootfs = /var/lib/lxc/cached/rootfs\nlxc.utsname = cached\nlxc.network.hwaddr = 00:16:3e:00:00:01\n",
+			"lxc.rootfs = /srv/lxc/packer/rootfs\nlxc.utsname = packer\nlxc.network.hwaddr = 00:16:3e:",
+		},
+	}
+	for _, c := range cases {
+		var written string
+		config := c.config
+		driver := &MockDriver{SudoFn: func(cmd *HostCmd) error {
+			switch cmd.Args[0] {
+			case "cat":
+				if cmd.Args[1] != "/srv/lxc/packer/config" {
+					t.Errorf("%s: read %s", c.name, cmd.Args[1])
+				}
+				cmd.Stdout.Write([]byte(config))
+			case "tee":
+				content, _ := ioutil.ReadAll(cmd.Stdin)
+				written = string(content)
+			}
+			return nil
+		}}
+
+		if err := renameContainerConfig(context.Background(), driver, "/srv/lxc", "packer"); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !strings.HasPrefix(written, c.want) {
+			t.Errorf("%s: config\n%s\nwant\n%s", c.name, written, c.want)
+		}
+		if strings.Contains(written, "00:16:3e:00:00:01") {
+			t.Errorf("%s: MAC address of the cached container kept:\n%s", c.name, written)
+		}
+	}
+}
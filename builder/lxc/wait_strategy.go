@@ -0,0 +1,179 @@
+package lxc
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	WaitStrategyAuto       = "auto"
+	WaitStrategyRunlevel   = "runlevel"
+	WaitStrategySystemd    = "systemd"
+	WaitStrategyOpenRC     = "openrc"
+	WaitStrategyFileExists = "file_exists"
+	WaitStrategyCommand    = "command"
+)
+
+// waitStrategy decides whether the init system of a container is done
+// booting.
+type waitStrategy interface {
+	// Ready is polled until it returns true or the init timeout is hit.
+	// Errors are logged and treated as not ready yet.
+	Ready(comm *LxcAttachCommunicator) (bool, error)
+}
+
+// newWaitStrategy returns the wait strategy for the configured
+// wait_strategy. The "auto" strategy inspects the rootfs to find the init
+// system of the container.
+func newWaitStrategy(config *Config, comm *LxcAttachCommunicator) (waitStrategy, error) {
+	strategy := config.WaitStrategy
+	if strategy == WaitStrategyAuto {
+		var err error
+		if strategy, err = detectWaitStrategy(comm); err != nil {
+			return nil, err
+		}
+		log.Printf("Detected wait strategy: %s", strategy)
+	}
+
+	switch strategy {
+	case WaitStrategyRunlevel:
+		return &runlevelWait{Runlevel: config.TargetRunlevel}, nil
+	case WaitStrategySystemd:
+		return &systemdWait{AcceptDegraded: config.WaitAcceptDegraded}, nil
+	case WaitStrategyOpenRC:
+		return &openrcWait{Runlevel: config.WaitOpenRCRunlevel}, nil
+	case WaitStrategyFileExists:
+		return &fileExistsWait{Path: config.WaitFile}, nil
+	case WaitStrategyCommand:
+		return &commandWait{
+			Command:  config.WaitCommand,
+			ExitCode: config.WaitCommandExitCode,
+			Output:   config.WaitCommandOutput,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown wait strategy: %s", strategy)
+}
+
+// detectWaitStrategy guesses the init system of the container by looking
+// at what /sbin/init resolves to in its rootfs.
+func detectWaitStrategy(comm *LxcAttachCommunicator) (string, error) {
+	initPath, err := comm.rootfsPath("/sbin/init")
+	if err != nil {
+		return "", err
+	}
+
+	switch filepath.Base(initPath) {
+	case "systemd":
+		return WaitStrategySystemd, nil
+	case "openrc-init":
+		return WaitStrategyOpenRC, nil
+	}
+
+	for _, path := range []string{"/sbin/openrc", "/sbin/rc-status", "/bin/rc-status"} {
+		exists, err := comm.exists(path)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return WaitStrategyOpenRC, nil
+		}
+	}
+
+	return WaitStrategyRunlevel, nil
+}
+
+// runlevelWait waits until /sbin/runlevel reports the target runlevel.
+type runlevelWait struct {
+	Runlevel int
+}
+
+func (w *runlevelWait) Ready(comm *LxcAttachCommunicator) (bool, error) {
+	runlevel, err := comm.CheckInit()
+	if err != nil {
+		return false, err
+	}
+
+	currentRunlevel := "unknown"
+	if arr := strings.Split(runlevel, " "); len(arr) >= 2 {
+		currentRunlevel = arr[1]
+	}
+
+	log.Printf("Current runlevel in container: '%s'", runlevel)
+	return currentRunlevel == fmt.Sprintf("%d", w.Runlevel), nil
+}
+
+// systemdWait waits until systemd reports the system as running, or
+// degraded when AcceptDegraded is set.
+type systemdWait struct {
+	AcceptDegraded bool
+}
+
+func (w *systemdWait) Ready(comm *LxcAttachCommunicator) (bool, error) {
+	// is-system-running exits non-zero for anything but "running", the
+	// state printed is all that matters here.
+	output, _, err := comm.Output("systemctl is-system-running")
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Current systemd state in container: '%s'", output)
+	switch output {
+	case "running":
+		return true, nil
+	case "degraded":
+		return w.AcceptDegraded, nil
+	}
+	return false, nil
+}
+
+// openrcWait waits until OpenRC reports the target runlevel.
+type openrcWait struct {
+	Runlevel string
+}
+
+func (w *openrcWait) Ready(comm *LxcAttachCommunicator) (bool, error) {
+	output, _, err := comm.Output("rc-status --runlevel")
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Current OpenRC runlevel in container: '%s'", output)
+	return output == w.Runlevel, nil
+}
+
+// fileExistsWait waits until a file exists in the container.
+type fileExistsWait struct {
+	Path string
+}
+
+func (w *fileExistsWait) Ready(comm *LxcAttachCommunicator) (bool, error) {
+	_, exitStatus, err := comm.Output(ShellJoin("test", "-e", w.Path))
+	if err != nil {
+		return false, err
+	}
+	return exitStatus == 0, nil
+}
+
+// commandWait waits until a command exits with the expected exit code and,
+// if set, prints the expected output.
+type commandWait struct {
+	Command  string
+	ExitCode int
+	Output   string
+}
+
+func (w *commandWait) Ready(comm *LxcAttachCommunicator) (bool, error) {
+	output, exitStatus, err := comm.Output(w.Command)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Wait command exited with '%d': '%s'", exitStatus, output)
+	if exitStatus != w.ExitCode {
+		return false, nil
+	}
+	return w.Output == "" || output == w.Output, nil
+}
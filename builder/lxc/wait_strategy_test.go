@@ -0,0 +1,92 @@
+package lxc
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWaitStrategies(t *testing.T) {
+	cases := []struct {
+		name     string
+		strategy waitStrategy
+		command  string
+		output   string
+		exit     int
+		ready    bool
+	}{
+		{"runlevel", &runlevelWait{Runlevel: 3}, "/sbin/runlevel", "N 3", 0, true},
+		{"runlevel booting", &runlevelWait{Runlevel: 3}, "/sbin/runlevel", "unknown", 0, false},
+		{"systemd running", &systemdWait{}, "systemctl is-system-running", "running", 0, true},
+		{"systemd starting", &systemdWait{}, "systemctl is-system-running", "starting", 1, false},
+		{"systemd degraded", &systemdWait{}, "systemctl is-system-running", "degraded", 1, false},
+		{"systemd degraded accepted", &systemdWait{AcceptDegraded: true}, "systemctl is-system-running", "degraded", 1, true},
+		{"openrc", &openrcWait{Runlevel: "default"}, "rc-status --runlevel", "default", 0, true},
+		{"openrc boot", &openrcWait{Runlevel: "default"}, "rc-status --runlevel", "boot", 0, false},
+		{"file exists", &fileExistsWait{Path: "/run/ready"}, "test -e /run/ready", "", 0, true},
+		{"file missing", &fileExistsWait{Path: "/run/ready"}, "test -e /run/ready", "", 1, false},
+		{"command", &commandWait{Command: "cloud-init status", Output: "status: done"}, "cloud-init status", "status: done", 0, true},
+		{"command output", &commandWait{Command: "cloud-init status", Output: "status: done"}, "cloud-init status", "status: running", 0, false},
+		{"command exit code", &commandWait{Command: "check", ExitCode: 2}, "check", "", 2, true},
+		{"command fails", &commandWait{Command: "check"}, "check", "", 1, false},
+	}
+	for _, c := range cases {
+		driver := new(MockDriver)
+		driver.setState("packer", "RUNNING")
+		var ran string
+		output, exit := c.output, c.exit
+		driver.AttachFn = func(name string, cmd *AttachCmd) (int, error) {
+			ran = cmd.Args[len(cmd.Args)-1]
+			if cmd.Args[0] != "/bin/sh" {
+				ran = strings.Join(cmd.Args, " ")
+			}
+			io.WriteString(cmd.Stdout, output+"\n")
+			return exit, nil
+		}
+		comm := &LxcAttachCommunicator{ContainerName: "packer", Driver: driver}
+
+		ready, err := c.strategy.Ready(comm)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		if ready != c.ready {
+			t.Errorf("%s: ready = %t, want %t", c.name, ready, c.ready)
+		}
+		if ran != c.command {
+			t.Errorf("%s: ran %q, want %q", c.name, ran, c.command)
+		}
+	}
+}
+
+func TestDetectWaitStrategy(t *testing.T) {
+	cases := []struct {
+		init  string
+		files []string
+		want  string
+	}{
+		{"/lib/systemd/systemd", nil, WaitStrategySystemd},
+		{"/sbin/openrc-init", nil, WaitStrategyOpenRC},
+		{"/bin/busybox", []string{"sbin/openrc"}, WaitStrategyOpenRC},
+		{"/bin/busybox", []string{"bin/rc-status"}, WaitStrategyOpenRC},
+		{"/bin/busybox", nil, WaitStrategyRunlevel},
+	}
+	for _, c := range cases {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+		testFiles(t, dir, append([]string{"sbin/", "lib/systemd/systemd", "sbin/openrc-init", "bin/busybox"}, c.files...)...)
+		if err := os.Symlink(c.init, filepath.Join(dir, "sbin", "init")); err != nil {
+			t.Fatal(err)
+		}
+
+		comm := &LxcAttachCommunicator{ContainerName: "packer", RootFs: dir, Driver: new(MockDriver)}
+		strategy, err := detectWaitStrategy(comm)
+		if err != nil {
+			t.Fatalf("%s: %s", c.init, err)
+		}
+		if strategy != c.want {
+			t.Errorf("%s with %q: detected %s, want %s", c.init, c.files, strategy, c.want)
+		}
+	}
+}
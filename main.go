@@ -1,11 +1,18 @@
 package main
 
 import (
+	"os"
+
 	"github.com/hashicorp/packer/packer/plugin"
 	"github.com/saucelabs/packer-builder-lxc/builder/lxc"
 )
 
 func main() {
+	// The builder runs the plugin through sudo to extract archives as root
+	if len(os.Args) > 1 && os.Args[1] == lxc.ExtractCommand {
+		os.Exit(lxc.ExtractMain(os.Args[2:]))
+	}
+
 	server, err := plugin.Server()
 	if err != nil {
 		panic(err)